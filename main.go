@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
 
 	"github.com/docker-infra/byte-piper/pipeline"
 )
 
 var (
 	debugEndpoint  = flag.String("d", "", "Enable pprof debugging endpoint on given host:port")
-	loop           = flag.Duration("r", 0, "Daemon mode; Repeat pipelines at given interval")
+	loop           = flag.Duration("r", 0, "Daemon mode; Repeat pipelines without schedule at given interval")
 	prometheusAddr = flag.String("l", "", "Expose prometheus metrics on given host:port, requires daemon mode")
+	concurrency    = flag.Int("j", 4, "Maximum number of pipelines running concurrently, 0 for no limit")
 	backupDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "bytes_piper_backup_duration_seconds",
 		Help: "Duration of given backup pipeline",
@@ -29,6 +36,10 @@ var (
 		Name: "bytes_piper_backup_size_bytes",
 		Help: "Bytes ran through the backup pipeline",
 	}, []string{"name"})
+	outputSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bytes_piper_backup_output_size_bytes",
+		Help: "Bytes written to the given output of the backup pipeline",
+	}, []string{"name", "output"})
 	backupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "bytes_piper_backups_total",
 		Help: "Total number of backups pipeline runs",
@@ -38,6 +49,10 @@ var (
 		Help: "Total number of failed backups pipeline runs",
 	}, []string{"name"})
 	plines pipelines
+
+	slots   chan struct{}
+	locksMu sync.Mutex
+	locks   = make(map[string]*sync.Mutex)
 )
 
 type pipelines []string
@@ -54,11 +69,23 @@ func init() {
 	prometheus.MustRegister(backupDuration)
 	prometheus.MustRegister(backupSeen)
 	prometheus.MustRegister(backupSize)
+	prometheus.MustRegister(outputSize)
 	prometheus.MustRegister(backupsTotal)
 	prometheus.MustRegister(backupsFailed)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "list":
+			list(os.Args[2:])
+			return
+		}
+	}
+
 	var listenErr chan error
 	flag.Var(&plines, "c", "Path to config, may be repeated")
 	flag.Parse()
@@ -67,8 +94,23 @@ func main() {
 		log.Fatal("No configs provided")
 	}
 
+	schedules := make(map[string]*pipeline.Schedule)
+	for _, file := range plines {
+		schedule, err := pipeline.ReadSchedule(file)
+		if err != nil {
+			log.Fatalf("ERROR loading %s: %s", file, err)
+		}
+		if schedule != nil {
+			schedules[file] = schedule
+		}
+	}
+	daemon := *loop > 0 || len(schedules) > 0
+	if *concurrency > 0 {
+		slots = make(chan struct{}, *concurrency)
+	}
+
 	if *prometheusAddr != "" {
-		if *loop == 0 {
+		if !daemon {
 			log.Fatal("Can only expose metrics in daemon mode")
 		}
 		http.Handle("/metrics", prometheus.Handler())
@@ -81,39 +123,212 @@ func main() {
 		}()
 	}
 
-	for {
-		for _, file := range plines {
-			log.Print("# Running ", file)
-			backupsTotal.WithLabelValues(file).Inc()
-			pipe, err := pipeline.New(file)
-			if err != nil {
-				log.Printf("ERROR loading %s: %s", file, err)
-				backupsFailed.WithLabelValues(file).Inc()
+	var wg sync.WaitGroup
+	for _, file := range plines {
+		schedule, ok := schedules[file]
+		runNow := false
+		if !ok {
+			if *loop == 0 {
 				continue
 			}
-			begin := time.Now()
-			bytesWritten, err := pipe.Run()
-			if err != nil {
-				log.Printf("ERROR running %s: %s", file, err)
-				backupsFailed.WithLabelValues(file).Inc()
+			// Without schedule, run now and repeat at the given interval
+			schedule = &pipeline.Schedule{Schedule: cron.Every(*loop)}
+			runNow = true
+		}
+		wg.Add(1)
+		go func(file string, schedule *pipeline.Schedule, runNow bool) {
+			defer wg.Done()
+			runScheduled(file, schedule, runNow)
+		}(file, schedule, runNow)
+	}
+	if *loop == 0 {
+		for _, file := range plines {
+			if _, ok := schedules[file]; ok {
 				continue
 			}
-			backupSize.WithLabelValues(file).Set(float64(bytesWritten))
-
-			now := time.Now()
-			backupSeen.WithLabelValues(file).Set(float64(now.Unix()))
-			backupDuration.WithLabelValues(file).Set(now.Sub(begin).Seconds())
-		}
-		if *loop == 0 {
-			break
+			wg.Add(1)
+			go func(file string) {
+				defer wg.Done()
+				run(file)
+			}(file)
 		}
-		plines = pipelines{}
-		log.Print("Sleeping for ", *loop)
-		time.Sleep(*loop)
-		flag.Parse() // We can do that nicer..
 	}
+	wg.Wait()
+
 	if *debugEndpoint != "" {
 		log.Print("Debugging enabled, keep listening for debugging")
 		log.Print(<-listenErr)
 	}
 }
+
+// restore runs the inverse of the given backup pipeline.
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	config := fs.String("c", "", "Path to config of the backup to restore")
+	from := fs.String("o", "", "Name of the output to restore from, defaults to the first")
+	manifest := fs.String("m", "", "Path to the manifest of the backup to restore, see list")
+	fs.Parse(args)
+	if *config == "" {
+		log.Fatal("No config provided")
+	}
+
+	if *manifest == "" {
+		pipe, err := pipeline.NewRestore(*config, *from)
+		if err != nil {
+			log.Fatalf("ERROR loading %s: %s", *config, err)
+		}
+		runRestore(pipe, *config)
+		return
+	}
+	m, err := pipeline.ReadManifest(*manifest)
+	if err != nil {
+		log.Fatalf("ERROR reading manifest %s: %s", *manifest, err)
+	}
+	// Incremental backups are restored by replaying the chain they're
+	// based on, starting with the full backup.
+	chain, err := pipeline.RestoreChain(*config, m)
+	if err != nil {
+		log.Fatalf("ERROR finding backups to restore %s: %s", *manifest, err)
+	}
+	for _, m := range chain {
+		log.Printf("Restoring level %d backup %s", m.Level, m.Location)
+		pipe, err := pipeline.NewRestoreManifest(*config, m)
+		if err != nil {
+			log.Fatalf("ERROR loading %s: %s", *config, err)
+		}
+		runRestore(pipe, *config)
+	}
+}
+
+func runRestore(pipe *pipeline.Pipeline, config string) {
+	result, err := pipe.Run()
+	if err != nil {
+		log.Fatalf("ERROR restoring %s: %s", config, err)
+	}
+	log.Printf("Restored %d bytes from %s", result.Bytes, config)
+}
+
+// list prints the restore points recorded in the catalog.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	config := fs.String("c", "", "Path to config, lists the backups of this pipeline")
+	catalog := fs.String("catalog", "", "Path to catalog, lists the backups of all pipelines")
+	fs.Parse(args)
+
+	name := ""
+	if *config != "" {
+		var err error
+		*catalog, name, err = pipeline.ReadCatalogConfig(*config)
+		if err != nil {
+			log.Fatalf("ERROR loading %s: %s", *config, err)
+		}
+	}
+	if *catalog == "" {
+		log.Fatal("No catalog provided")
+	}
+	manifests, err := pipeline.ReadCatalog(*catalog, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "START\tPIPELINE\tOUTPUT\tLOCATION\tLEVEL\tSIZE\tSHA256")
+	for _, m := range manifests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", m.Start.Format(time.RFC3339), m.Pipeline, m.Output, m.Location, m.Level, m.Size, m.Checksum)
+	}
+	w.Flush()
+}
+
+// runScheduled runs the given pipeline according to its schedule,
+// forever. The next run is calculated from the previous scheduled time,
+// so the schedule doesn't drift by the time a run takes. Runs missed
+// because of a long run are skipped.
+func runScheduled(file string, schedule *pipeline.Schedule, runNow bool) {
+	if runNow {
+		run(file)
+	}
+	next := time.Now()
+	for {
+		next = schedule.Next(next)
+		if now := time.Now(); next.Before(now) {
+			next = schedule.Next(now)
+		}
+		at := next.Add(schedule.RandomJitter())
+		log.Printf("# Scheduled %s at %s", file, at)
+		time.Sleep(at.Sub(time.Now()))
+		run(file)
+	}
+}
+
+// acquire blocks until the given locks and a free slot are acquired and
+// returns a function releasing them. Locks are acquired in order, so
+// pipelines sharing more than one lock can't deadlock.
+func acquire(names []string) func() {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	held := []*sync.Mutex{}
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		locksMu.Lock()
+		l, ok := locks[name]
+		if !ok {
+			l = &sync.Mutex{}
+			locks[name] = l
+		}
+		locksMu.Unlock()
+		l.Lock()
+		held = append(held, l)
+	}
+	if slots != nil {
+		slots <- struct{}{}
+	}
+	return func() {
+		if slots != nil {
+			<-slots
+		}
+		for _, l := range held {
+			l.Unlock()
+		}
+	}
+}
+
+func run(file string) {
+	backupsTotal.WithLabelValues(file).Inc()
+	names, err := pipeline.ReadLocks(file)
+	if err != nil {
+		log.Printf("ERROR loading %s: %s", file, err)
+		backupsFailed.WithLabelValues(file).Inc()
+		return
+	}
+	release := acquire(names)
+	defer release()
+
+	log.Print("# Running ", file)
+	pipe, err := pipeline.New(file)
+	if err != nil {
+		log.Printf("ERROR loading %s: %s", file, err)
+		backupsFailed.WithLabelValues(file).Inc()
+		return
+	}
+	begin := time.Now()
+	ctx, cancel := context.Background(), func() {}
+	if timeout := pipe.Timeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	result, err := pipe.RunContext(ctx)
+	cancel()
+	for _, o := range result.Outputs {
+		outputSize.WithLabelValues(file, o.Name).Set(float64(o.Bytes))
+	}
+	if err != nil {
+		log.Printf("ERROR running %s: %s", file, err)
+		backupsFailed.WithLabelValues(file).Inc()
+		return
+	}
+	backupSize.WithLabelValues(file).Set(float64(result.Bytes))
+
+	now := time.Now()
+	backupSeen.WithLabelValues(file).Set(float64(now.Unix()))
+	backupDuration.WithLabelValues(file).Set(now.Sub(begin).Seconds())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// holders counts the goroutines holding each lock and fails the test if
+// more than one does.
+type holders struct {
+	t      *testing.T
+	mu     sync.Mutex
+	held   map[string]int
+	active int
+	max    int
+}
+
+func (h *holders) enter(names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range unique(names) {
+		h.held[name]++
+		if h.held[name] > 1 {
+			h.t.Errorf("Lock %s held concurrently", name)
+		}
+	}
+	h.active++
+	if h.active > h.max {
+		h.max = h.active
+	}
+}
+
+func (h *holders) leave(names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, name := range unique(names) {
+		h.held[name]--
+	}
+	h.active--
+}
+
+func unique(names []string) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// runAll runs fn concurrently for each lock set, n times each, and fails
+// if they don't finish in time, like when deadlocked.
+func runAll(t *testing.T, sets [][]string, n int, fn func(names []string)) {
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, names := range sets {
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(names []string) {
+					defer wg.Done()
+					fn(names)
+				}(names)
+			}
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Pipelines deadlocked")
+	}
+}
+
+func TestAcquireLocks(t *testing.T) {
+	h := &holders{t: t, held: make(map[string]int)}
+	// Opposite orders would deadlock without sorting
+	sets := [][]string{{"a", "b"}, {"b", "a"}, {"b", "c"}, {"c", "a", "c"}, {}}
+	runAll(t, sets, 20, func(names []string) {
+		release := acquire(names)
+		h.enter(names)
+		time.Sleep(time.Millisecond)
+		h.leave(names)
+		release()
+	})
+}
+
+func TestAcquireSlots(t *testing.T) {
+	slots = make(chan struct{}, 2)
+	defer func() { slots = nil }()
+	h := &holders{t: t, held: make(map[string]int)}
+	runAll(t, [][]string{{"a"}, {"b"}, {"c"}, {}}, 5, func(names []string) {
+		release := acquire(names)
+		h.enter(names)
+		time.Sleep(5 * time.Millisecond)
+		h.leave(names)
+		release()
+	})
+	if h.max != 2 {
+		t.Fatalf("Expected 2 pipelines running concurrently, got %d", h.max)
+	}
+}
+
+func TestRunLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "byte-piper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each run records when it started and ended
+	files := []string{}
+	for i, locks := range []string{`["db"]`, `["db", "host"]`, `["host", "db"]`} {
+		file := filepath.Join(dir, fmt.Sprintf("backup%d.json", i))
+		if err := ioutil.WriteFile(file, []byte(fmt.Sprintf(`{
+			"locks": %s,
+			"input": {"type": "command", "config": {"command": "sh -c 'date +%%s%%N; sleep 0.2; date +%%s%%N'"}},
+			"output": {"type": "file", "config": {"path": %q}}
+		}`, locks, filepath.Join(dir, fmt.Sprintf("times%d", i)))), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	var wg sync.WaitGroup
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			run(file)
+		}(file)
+	}
+	wg.Wait()
+
+	intervals := [][2]int64{}
+	for i := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("times%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		times := strings.Fields(string(data))
+		if len(times) != 2 {
+			t.Fatalf("Unexpected output %q", data)
+		}
+		begin, _ := strconv.ParseInt(times[0], 10, 64)
+		end, _ := strconv.ParseInt(times[1], 10, 64)
+		intervals = append(intervals, [2]int64{begin, end})
+	}
+	for i, a := range intervals {
+		for _, b := range intervals[i+1:] {
+			if a[0] < b[1] && b[0] < a[1] {
+				t.Fatalf("Pipelines sharing a lock ran concurrently: %v", intervals)
+			}
+		}
+	}
+}
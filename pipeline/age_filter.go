@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+func init() {
+	filterMap["age"] = newAgeFilter
+	filterInverseMap["age"] = inverseAs("unage", "work_factor")
+}
+
+// newAgeFilter returns a filter encrypting to the recipients, given in
+// recipients (comma separated) or recipients_file (one per line), or with
+// the passphrase.
+func newAgeFilter(conf map[string]string) (filter, error) {
+	recipients, err := readAgeRecipients(conf)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(conf, "passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != nil {
+		if len(recipients) > 0 {
+			return nil, errors.New("passphrase can't be combined with recipients")
+		}
+		r, err := age.NewScryptRecipient(string(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		if conf["work_factor"] != "" {
+			n, err := strconv.Atoi(conf["work_factor"])
+			if err != nil || n < 1 || n > 30 {
+				return nil, fmt.Errorf("Invalid work_factor %s", conf["work_factor"])
+			}
+			r.SetWorkFactor(n)
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("recipients, recipients_file or passphrase required")
+	}
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return age.Encrypt(w, recipients...)
+	}}, nil
+}
+
+// readAgeRecipients returns the X25519 and SSH recipients of the config.
+// Empty lines and comments in recipients_file are ignored, like by age -R.
+func readAgeRecipients(conf map[string]string) ([]age.Recipient, error) {
+	lines := strings.Split(conf["recipients"], ",")
+	if file := conf["recipients_file"]; file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read recipients_file: %s", err)
+		}
+		lines = append(lines, strings.Split(string(data), "\n")...)
+	}
+	recipients := []age.Recipient{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var (
+			r   age.Recipient
+			err error
+		)
+		if strings.HasPrefix(line, "ssh-") {
+			r, err = agessh.ParseRecipient(line)
+		} else {
+			r, err = age.ParseX25519Recipient(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient %s: %s", line, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
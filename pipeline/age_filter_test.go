@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/ssh"
+	"filippo.io/age"
+)
+
+func TestFilterAge(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPriv := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	for _, test := range []struct {
+		age, unage map[string]string
+	}{
+		{
+			map[string]string{"recipients": x25519.Recipient().String() + "," + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))},
+			map[string]string{"identity": x25519.String()},
+		},
+		{
+			map[string]string{"recipients": x25519.Recipient().String() + "," + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))},
+			map[string]string{"identity": string(sshPriv)},
+		},
+		{
+			map[string]string{"passphrase": "secret", "work_factor": "10"},
+			map[string]string{"passphrase": "secret"},
+		},
+	} {
+		f, err := newAgeFilter(test.age)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Link(bytes.NewBufferString(expectedText)); err != nil {
+			t.Fatal(err)
+		}
+		unage, err := newUnageFilter(test.unage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unage.Link(f); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(unage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expectedText {
+			t.Fatalf("Unexpected string %q", out)
+		}
+	}
+}
+
+func TestFilterAgeWrongIdentity(t *testing.T) {
+	recipient, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newAgeFilter(map[string]string{"recipients": recipient.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Link(bytes.NewBufferString(expectedText)); err != nil {
+		t.Fatal(err)
+	}
+	unage, err := newUnageFilter(map[string]string{"identity": other.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unage.Link(f); err == nil {
+		t.Fatal("Expected decryption with other identity to fail")
+	}
+}
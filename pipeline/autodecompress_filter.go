@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+)
+
+// magics maps the magic bytes of compressed streams to the filter
+// decompressing them.
+var magics = []struct {
+	magic  []byte
+	filter string
+}{
+	{[]byte{0x1f, 0x8b}, "gunzip"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "unzstd"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "unxz"},
+	{[]byte("BZh"), "bunzip2"},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, "unlz4"},
+}
+
+func init() {
+	filterMap["autodecompress"] = newAutodecompressFilter
+}
+
+// autodecompressFilter detects the compression of the data by its magic
+// bytes and decompresses it with the matching filter, which gets the
+// config of this filter. Data not recognized is passed through.
+type autodecompressFilter struct {
+	conf map[string]string
+	br   *bufio.Reader
+	r    io.Reader
+}
+
+func newAutodecompressFilter(conf map[string]string) (filter, error) {
+	return &autodecompressFilter{conf: conf}, nil
+}
+
+func (f *autodecompressFilter) Link(r io.Reader) error {
+	f.br = bufio.NewReader(r)
+	return nil
+}
+
+// Read detects the compression on the first read, so linking doesn't
+// block on the previous stage.
+func (f *autodecompressFilter) Read(p []byte) (int, error) {
+	if f.r == nil {
+		if err := f.detect(); err != nil {
+			return 0, err
+		}
+	}
+	return f.r.Read(p)
+}
+
+func (f *autodecompressFilter) detect() error {
+	head, err := f.br.Peek(6)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for _, m := range magics {
+		if !bytes.HasPrefix(head, m.magic) {
+			continue
+		}
+		log.Printf("Detected %s compressed data", m.filter)
+		decompress, err := filterMap[m.filter](f.conf)
+		if err != nil {
+			return err
+		}
+		if err := decompress.Link(f.br); err != nil {
+			return err
+		}
+		f.r = decompress
+		return nil
+	}
+	log.Print("No compression detected, passing data through")
+	f.r = f.br
+	return nil
+}
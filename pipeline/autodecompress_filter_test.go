@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFilterAutodecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World "), 1000)
+	for _, compress := range []string{"gzip", "zstd", "xz", "bzip2", "lz4", ""} {
+		var r io.Reader = bytes.NewReader(data)
+		if compress != "" {
+			f, err := filterMap[compress](map[string]string{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Link(r); err != nil {
+				t.Fatal(err)
+			}
+			r = f
+		}
+		auto, err := newAutodecompressFilter(map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := auto.Link(r); err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if _, err := io.Copy(out, auto); err != nil {
+			t.Fatalf("%s: %s", compress, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("Unexpected output for %s", compress)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package pipeline
+
+import (
+	"compress/bzip2"
+	"io"
+)
+
+func init() {
+	filterMap["bunzip2"] = newBunzip2Filter
+	filterInverseMap["bunzip2"] = inverseAs("bzip2")
+}
+
+func newBunzip2Filter(map[string]string) (filter, error) {
+	return &decompressFilter{newReader: func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r), nil
+	}}, nil
+}
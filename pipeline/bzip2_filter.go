@@ -0,0 +1,29 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+func init() {
+	filterMap["bzip2"] = newBzip2Filter
+	filterInverseMap["bzip2"] = inverseAs("bunzip2")
+}
+
+// newBzip2Filter returns a bzip2 compressing filter. Options: level (1-9).
+func newBzip2Filter(conf map[string]string) (filter, error) {
+	wc := &bzip2.WriterConfig{}
+	if level := conf["level"]; level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < bzip2.BestSpeed || n > bzip2.BestCompression {
+			return nil, fmt.Errorf("Invalid bzip2 level %s", level)
+		}
+		wc.Level = n
+	}
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return bzip2.NewWriter(w, wc)
+	}}, nil
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Version is recorded in manifests. Set it at build time with
+// -ldflags "-X github.com/docker-infra/byte-piper/pipeline.Version=..."
+var Version = "dev"
+
+// Manifest describes a backup written to one output by a successful run.
+type Manifest struct {
+	Pipeline    string    `json:"pipeline"`
+	ConfigHash  string    `json:"config_hash"` // sha256 of the config file
+	Stages      []string  `json:"stages"`      // Types of input and filters
+	Output      string    `json:"output"`      // Name of the output
+	OutputType  string    `json:"output_type"`
+	LocationKey string    `json:"location_key,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`        // sha256 of the data written
+	Level       int       `json:"level,omitempty"` // 0 for full backups
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Version     string    `json:"version"`
+}
+
+// manifestPath returns the path of the manifest in the catalog directory,
+// <catalog>/<pipeline>/<start>-<output>.json
+func manifestPath(catalog string, m *Manifest) string {
+	name := fmt.Sprintf("%s-%s.json", m.Start.UTC().Format("20060102T150405.000000000Z"), m.Output)
+	return filepath.Join(catalog, m.Pipeline, name)
+}
+
+// writeManifest writes the manifest to the catalog directory.
+func writeManifest(catalog string, m *Manifest) error {
+	path := manifestPath(catalog, m)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ReadManifest reads a single manifest file.
+func ReadManifest(file string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	return m, json.Unmarshal(data, m)
+}
+
+// ReadCatalog returns all manifests in the catalog directory, or only
+// those of the given pipeline if name isn't empty, oldest first.
+func ReadCatalog(catalog, name string) ([]*Manifest, error) {
+	pattern := filepath.Join(catalog, "*", "*.json")
+	if name != "" {
+		pattern = filepath.Join(catalog, name, "*.json")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []*Manifest{}
+	for _, file := range files {
+		m, err := ReadManifest(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read manifest %s: %s", file, err)
+		}
+		manifests = append(manifests, m)
+	}
+	sort.Sort(byStart(manifests))
+	return manifests, nil
+}
+
+// ReadCatalogConfig returns the catalog directory and name of the given
+// pipeline config.
+func ReadCatalogConfig(configFile string) (catalog, name string, err error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return "", "", err
+	}
+	return conf.Catalog, conf.Name, nil
+}
+
+// manifest returns a manifest for the given output of the current run.
+func (p *Pipeline) manifest(s *sink, checksum string, start, end time.Time) *Manifest {
+	return &Manifest{
+		Pipeline:    p.vars.Name,
+		ConfigHash:  p.configHash,
+		Stages:      p.stages,
+		Output:      s.name,
+		OutputType:  s.typ,
+		LocationKey: s.locationKey,
+		Location:    s.location,
+		Size:        s.n,
+		Checksum:    checksum,
+		Level:       p.level,
+		Start:       start,
+		End:         end,
+		Version:     Version,
+	}
+}
+
+type byStart []*Manifest
+
+func (m byStart) Len() int           { return len(m) }
+func (m byStart) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byStart) Less(i, j int) bool { return m[i].Start.Before(m[j].Start) }
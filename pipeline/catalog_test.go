@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	catalog, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(catalog)
+
+	for i := 0; i < 2; i++ {
+		p := &Pipeline{
+			vars:    &Vars{Name: "test"},
+			input:   bytes.NewBuffer([]byte("Hello World")),
+			outputs: []namedOutput{{name: "buffer", typ: "buffer", output: &buffer{}}},
+			catalog: catalog,
+			stages:  []string{"buffer"},
+		}
+		if _, err := p.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifests, err := ReadCatalog(catalog, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 2 || manifests[0].Start.After(manifests[1].Start) {
+		t.Fatalf("Unexpected manifests %v", manifests)
+	}
+	m := manifests[1]
+	if m.Pipeline != "test" || m.Output != "buffer" || m.Size != 11 ||
+		m.Checksum != "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e" {
+		t.Fatalf("Unexpected manifest %#v", m)
+	}
+}
+
+func TestCatalogPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	catalog := filepath.Join(dir, "catalog")
+	configFile := filepath.Join(dir, "pruned.json")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`{
+		"catalog": %q,
+		"input": {"type": "command", "config": {"command": "echo Hello World"}},
+		"output": {"type": "file", "config": {"path": %q, "keep_last": "2"}}
+	}`, catalog, filepath.Join(dir, "{{.Time.UnixNano}}.txt"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		p, err := New(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifests, err := ReadCatalog(catalog, "pruned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 2 {
+		t.Fatalf("Expected manifests of pruned backups to be removed, got %d", len(manifests))
+	}
+	for _, m := range manifests {
+		if _, err := os.Stat(m.Location); err != nil {
+			t.Fatalf("Manifest of missing backup: %s", err)
+		}
+	}
+}
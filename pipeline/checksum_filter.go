@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const defaultChecksumAlgorithm = "sha256"
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil) // Only fails for invalid keys
+		return h
+	},
+}
+
+func init() {
+	filterMap["checksum"] = newChecksumFilter
+	filterInverseMap["checksum"] = func(conf map[string]string) (commonConfig, error) {
+		c, _ := inverseAs("checksum", "algorithm")(conf)
+		c.Config["verify"] = "true"
+		return c, nil
+	}
+}
+
+// digester is implemented by filters calculating a digest of the data
+// passing through. After a successful run, outputs supporting sidecars
+// store it next to the backup.
+type digester interface {
+	// digest returns the suffix of the sidecar and the digest, nil if
+	// nothing is to be stored.
+	digest() (suffix string, sum []byte)
+}
+
+// verifier is implemented by filters verifying the data passing through
+// against the digest stored next to the backup read by the input.
+type verifier interface {
+	// sidecarSuffix returns the suffix of the sidecar to read, empty if
+	// no digest is needed.
+	sidecarSuffix() string
+	setExpected(sum []byte)
+}
+
+// checksumFilter passes through all data, calculating its digest. In
+// verify mode, reading fails at the end of the data if the digest doesn't
+// match the expected one.
+type checksumFilter struct {
+	algorithm string
+	hash      hash.Hash
+	r         io.Reader
+	verify    bool
+	expected  []byte
+}
+
+func newChecksumFilter(conf map[string]string) (filter, error) {
+	algorithm := conf["algorithm"]
+	if algorithm == "" {
+		algorithm = defaultChecksumAlgorithm
+	}
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Invalid checksum algorithm %s", algorithm)
+	}
+	f := &checksumFilter{
+		algorithm: algorithm,
+		hash:      newHash(),
+		verify:    conf["verify"] == "true",
+	}
+	if conf["expected"] != "" {
+		sum, err := hex.DecodeString(conf["expected"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expected checksum %s: %s", conf["expected"], err)
+		}
+		f.expected = sum
+		f.verify = true
+	}
+	return f, nil
+}
+
+func (f *checksumFilter) Link(r io.Reader) error {
+	f.r = io.TeeReader(r, f.hash)
+	return nil
+}
+
+func (f *checksumFilter) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF && f.verify {
+		if err := f.check(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (f *checksumFilter) check() error {
+	if f.expected == nil {
+		return fmt.Errorf("No %s checksum to verify against", f.algorithm)
+	}
+	if sum := f.hash.Sum(nil); !bytes.Equal(sum, f.expected) {
+		return fmt.Errorf("%s checksum mismatch: expected %x, got %x", f.algorithm, f.expected, sum)
+	}
+	return nil
+}
+
+func (f *checksumFilter) digest() (string, []byte) {
+	if f.verify {
+		return "", nil
+	}
+	return "." + f.algorithm, f.hash.Sum(nil)
+}
+
+func (f *checksumFilter) sidecarSuffix() string {
+	if !f.verify || f.expected != nil {
+		return ""
+	}
+	return "." + f.algorithm
+}
+
+func (f *checksumFilter) setExpected(sum []byte) {
+	f.expected = sum
+}
+
+// formatSidecar returns the sidecar for the given location, in the format
+// of sha256sum and friends.
+func formatSidecar(sum []byte, location string) []byte {
+	return []byte(fmt.Sprintf("%x  %s\n", sum, filepath.Base(location)))
+}
+
+// parseSidecar returns the digest of a sidecar.
+func parseSidecar(data []byte) ([]byte, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, errors.New("Empty checksum file")
+	}
+	return hex.DecodeString(fields[0])
+}
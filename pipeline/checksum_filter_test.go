@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in")
+	if err := ioutil.WriteFile(in, []byte("Hello World"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "backup")
+
+	conf := &config{
+		Name:    "checksum",
+		Input:   commonConfig{Type: "file", Config: map[string]string{"path": in}},
+		Filters: filterConfig{commonConfig: commonConfig{Type: "checksum"}},
+		Output:  outputConfig{commonConfig: commonConfig{Type: "file", Config: map[string]string{"path": backup}}},
+	}
+	p, err := newFromConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := ioutil.ReadFile(backup + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%x  backup\n", sha256.Sum256([]byte("Hello World"))); string(sidecar) != expected {
+		t.Fatalf("Unexpected sidecar %q, expected %q", sidecar, expected)
+	}
+
+	restore := func() error {
+		inverse, err := conf.inverse("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inverse.Output.Config["path"] = filepath.Join(dir, "restored")
+		p, err := newFromConfig(inverse)
+		if err != nil {
+			return err
+		}
+		_, err = p.Run()
+		return err
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backup, []byte("Hello Wörld"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err == nil {
+		t.Fatal("Expected restore of corrupted backup to fail")
+	}
+}
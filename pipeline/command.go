@@ -1,6 +1,12 @@
 package pipeline
 
-import "github.com/flynn/go-shlex"
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/flynn/go-shlex"
+)
 
 func parseCommand(line string) (string, []string, error) {
 	parts, err := shlex.Split(line)
@@ -10,3 +16,25 @@ func parseCommand(line string) (string, []string, error) {
 	}
 	return parts[0], args, err
 }
+
+// newCommand returns a command running in its own process group, so
+// killCommand also kills the processes it starts, like the ones of a
+// shell pipeline.
+func newCommand(name string, args ...string) *exec.Cmd {
+	command := exec.Command(name, args...)
+	command.Stderr = os.Stderr
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return command
+}
+
+// killCommand kills the process group of a command, if it was started.
+func killCommand(command *exec.Cmd) error {
+	if command.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil // Exited already
+	}
+	return err
+}
@@ -2,9 +2,11 @@ package pipeline
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os/exec"
+	"sync/atomic"
 )
 
 func init() {
@@ -12,8 +14,9 @@ func init() {
 }
 
 type commandFilter struct {
-	stdout  io.Reader
+	stdout  io.ReadCloser
 	command *exec.Cmd
+	aborted int32 // Set atomically by Abort
 }
 
 func newCommandFilter(conf map[string]string) (filter, error) {
@@ -26,7 +29,7 @@ func newCommandFilter(conf map[string]string) (filter, error) {
 		return nil, err
 	}
 	log.Printf("cmd: %s, args: %#v (from %s)", cmd, args, c)
-	command := exec.Command(cmd, args...)
+	command := newCommand(cmd, args...)
 	out, err := command.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -39,14 +42,31 @@ func newCommandFilter(conf map[string]string) (filter, error) {
 
 func (f *commandFilter) Link(r io.Reader) error {
 	f.command.Stdin = r
-	go func() {
-		if err := f.command.Run(); err != nil {
-			log.Printf("Couldn't execute %s: %s", f.command.Path, err)
-		}
-	}()
-	return nil
+	return f.command.Start()
 }
 
 func (f *commandFilter) Read(p []byte) (int, error) {
 	return f.stdout.Read(p)
 }
+
+// Abort kills the command with all processes it started and closes its
+// stdout, so reading returns right away.
+func (f *commandFilter) Abort() error {
+	atomic.StoreInt32(&f.aborted, 1)
+	err := killCommand(f.command)
+	f.stdout.Close()
+	return err
+}
+
+// Wait waits for the command to exit and returns an error if it failed,
+// errAborted if it was aborted. Wait must not be called before all
+// output was read.
+func (f *commandFilter) Wait() error {
+	if err := f.command.Wait(); err != nil {
+		if atomic.LoadInt32(&f.aborted) != 0 {
+			return errAborted
+		}
+		return fmt.Errorf("Couldn't execute %s: %s", f.command.Path, err)
+	}
+	return nil
+}
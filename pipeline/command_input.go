@@ -2,15 +2,23 @@ package pipeline
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
-	"os"
 	"os/exec"
+	"sync/atomic"
 )
 
 func init() {
 	inputMap["command"] = newCommandInput
 }
 
+type commandInput struct {
+	io.ReadCloser
+	command *exec.Cmd
+	aborted int32 // Set atomically by Abort
+}
+
 func newCommandInput(conf map[string]string) (input, error) {
 	c := conf["command"]
 	if c == "" {
@@ -21,8 +29,7 @@ func newCommandInput(conf map[string]string) (input, error) {
 		return nil, err
 	}
 	log.Printf("cmd: %s, args: %#v (from %s)", cmd, args, c)
-	command := exec.Command(cmd, args...)
-	command.Stderr = os.Stderr
+	command := newCommand(cmd, args...)
 	out, err := command.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -31,13 +38,30 @@ func newCommandInput(conf map[string]string) (input, error) {
 	if err := command.Start(); err != nil {
 		return nil, err
 	}
+	return &commandInput{
+		ReadCloser: out,
+		command:    command,
+	}, nil
+}
 
-	go func() {
-		if err := command.Wait(); err != nil {
-			log.Print(err)
-		}
-		out.Close()
-	}()
-	return out, nil
+// Abort kills the command with all processes it started and closes its
+// stdout, so reading returns right away.
+func (i *commandInput) Abort() error {
+	atomic.StoreInt32(&i.aborted, 1)
+	err := killCommand(i.command)
+	i.ReadCloser.Close()
+	return err
+}
 
+// Wait waits for the command to exit and returns an error if it failed,
+// errAborted if it was aborted. Wait must not be called before all
+// output was read.
+func (i *commandInput) Wait() error {
+	if err := i.command.Wait(); err != nil {
+		if atomic.LoadInt32(&i.aborted) != 0 {
+			return errAborted
+		}
+		return fmt.Errorf("Couldn't execute %s: %s", i.command.Path, err)
+	}
+	return nil
 }
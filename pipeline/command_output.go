@@ -2,6 +2,8 @@ package pipeline
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os/exec"
 )
 
@@ -9,6 +11,11 @@ func init() {
 	outputMap["command"] = newCommandOutput
 }
 
+type commandOutput struct {
+	io.WriteCloser
+	command *exec.Cmd
+}
+
 func newCommandOutput(conf map[string]string) (output, error) {
 	c := conf["command"]
 	if c == "" {
@@ -18,10 +25,32 @@ func newCommandOutput(conf map[string]string) (output, error) {
 	if err != nil {
 		return nil, err
 	}
-	command := exec.Command(cmd, args...)
-	out, err := command.StdinPipe()
+	command := newCommand(cmd, args...)
+	in, err := command.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
-	return out, command.Start()
+	return &commandOutput{
+		WriteCloser: in,
+		command:     command,
+	}, command.Start()
+}
+
+// Abort kills the command with all processes it started and closes its
+// stdin, so writing returns right away.
+func (o *commandOutput) Abort() error {
+	err := killCommand(o.command)
+	o.WriteCloser.Close()
+	return err
+}
+
+// Close closes stdin of the command and waits for it to exit.
+func (o *commandOutput) Close() error {
+	if err := o.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := o.command.Wait(); err != nil {
+		return fmt.Errorf("Couldn't execute %s: %s", o.command.Path, err)
+	}
+	return nil
 }
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"io"
+	"log"
+)
+
+// compressFilter compresses the data in the background, using the writer
+// returned by newWriter. Writers may write headers right away, so it's
+// created in the background too.
+type compressFilter struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	r         *io.PipeReader
+}
+
+func (f *compressFilter) Link(r io.Reader) error {
+	pr, pw := io.Pipe()
+	f.r = pr
+	go func() {
+		zw, err := f.newWriter(pw)
+		if err == nil {
+			_, err = io.Copy(zw, r)
+			if cerr := zw.Close(); err == nil { // Writes the footer, so close before pw
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return nil
+}
+
+func (f *compressFilter) Read(p []byte) (n int, err error) {
+	return f.r.Read(p)
+}
+
+// Abort closes the pipe, which stops the compression.
+func (f *compressFilter) Abort() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.CloseWithError(errAborted)
+}
+
+// decompressFilter decompresses the data using the reader returned by
+// newReader.
+type decompressFilter struct {
+	newReader func(r io.Reader) (io.Reader, error)
+	r         io.Reader
+}
+
+func (f *decompressFilter) Link(r io.Reader) error {
+	zr, err := f.newReader(r)
+	f.r = zr
+	return err
+}
+
+func (f *decompressFilter) Read(p []byte) (n int, err error) {
+	return f.r.Read(p)
+}
@@ -0,0 +1,21 @@
+package pipeline
+
+import "io"
+
+func init() {
+	filterMap["decrypt"] = newDecryptFilter
+	filterInverseMap["decrypt"] = inverseAs("encrypt", keySourceConfig...)
+}
+
+// newDecryptFilter returns a filter decrypting the data encrypted by the
+// encrypt filter. The cipher and chunk size are read from the data.
+// Reading fails if the data was truncated or tampered with.
+func newDecryptFilter(conf map[string]string) (filter, error) {
+	keys, err := newKeySource(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressFilter{newReader: func(r io.Reader) (io.Reader, error) {
+		return newStreamReader(r, keys)
+	}}, nil
+}
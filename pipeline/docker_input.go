@@ -59,7 +59,10 @@ func newDockerInput(conf map[string]string) (input, error) {
 		return nil, errors.New("Container has no volumes")
 	}
 
-	go di.store(container, containerJSON) // stores files and closes writers
+	go func() {
+		// stores files and closes writers, passing on errors to the reader
+		di.w.CloseWithError(di.store(container, containerJSON))
+	}()
 	return di, nil
 }
 
@@ -67,10 +70,12 @@ func (i *dockerInput) Read(p []byte) (n int, err error) {
 	return i.r.Read(p)
 }
 
-func (i *dockerInput) store(container *container, containerJSON []byte) {
-	defer i.w.Close()
-	defer i.tw.Close()
+// Abort closes the pipe, which stops storing the volumes.
+func (i *dockerInput) Abort() error {
+	return i.r.CloseWithError(errAborted)
+}
 
+func (i *dockerInput) store(container *container, containerJSON []byte) error {
 	now := time.Now()
 	if err := i.tw.WriteHeader(&tar.Header{
 		Name:       containerName,
@@ -80,20 +85,18 @@ func (i *dockerInput) store(container *container, containerJSON []byte) {
 		ChangeTime: now,
 		Mode:       0644,
 	}); err != nil {
-		i.w.CloseWithError(err)
-		return
+		return err
 	}
 	if _, err := i.tw.Write(containerJSON); err != nil {
-		i.w.CloseWithError(err)
-		return
+		return err
 	}
 
 	for _, path := range container.Volumes {
 		if err := filepath.Walk(path, i.addFile); err != nil {
-			i.w.CloseWithError(err)
-			return
+			return err
 		}
 	}
+	return i.tw.Close()
 }
 
 func (i *dockerInput) addFile(path string, info os.FileInfo, err error) error {
@@ -119,6 +122,7 @@ func (i *dockerInput) addFile(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		defer file.Close()
 		if _, err := io.Copy(i.tw, file); err != nil {
 			return err
 		}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+func init() {
+	filterMap["encrypt"] = newEncryptFilter
+	filterInverseMap["encrypt"] = inverseAs("decrypt", keySourceConfig...)
+}
+
+// newEncryptFilter returns a filter encrypting the data in chunks with
+// an AEAD. Options: cipher (aes-256-gcm or xchacha20-poly1305),
+// chunk_size and the key source: key_file, passphrase and work_factor
+// or key_service.
+func newEncryptFilter(conf map[string]string) (filter, error) {
+	cipherID := byte(cipherAES256GCM)
+	if conf["cipher"] != "" {
+		id, ok := streamCiphers[conf["cipher"]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid cipher %s", conf["cipher"])
+		}
+		cipherID = id
+	}
+	chunkSize := defaultChunkSize
+	if conf["chunk_size"] != "" {
+		n, err := strconv.Atoi(conf["chunk_size"])
+		if err != nil || n < 1 || n > maxChunkSize {
+			return nil, fmt.Errorf("Invalid chunk size %s", conf["chunk_size"])
+		}
+		chunkSize = n
+	}
+	keys, err := newKeySource(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return newStreamWriter(w, cipherID, chunkSize, keys)
+	}}, nil
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encrypt(t *testing.T, conf map[string]string, data []byte) []byte {
+	f, err := newEncryptFilter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Link(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func decrypt(conf map[string]string, data []byte) ([]byte, error) {
+	f, err := newDecryptFilter(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Link(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+func TestFilterEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conf := range []map[string]string{
+		{"key_file": keyFile, "chunk_size": "1024"},
+		{"key_file": keyFile, "chunk_size": "1024", "cipher": "xchacha20-poly1305"},
+		{"passphrase": "secret", "work_factor": "10", "chunk_size": "1024"},
+	} {
+		for _, size := range []int{0, 1, 1024, 3000, 4096} {
+			data := bytes.Repeat([]byte{'x'}, size)
+			out, err := decrypt(conf, encrypt(t, conf, data))
+			if err != nil {
+				t.Fatalf("Couldn't decrypt %d bytes with %v: %s", size, conf, err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("Unexpected output for %d bytes with %v", size, conf)
+			}
+		}
+	}
+}
+
+func TestFilterDecryptTampered(t *testing.T) {
+	conf := map[string]string{"passphrase": "secret", "work_factor": "10", "chunk_size": "1024"}
+	data := encrypt(t, conf, bytes.Repeat([]byte{'x'}, 4096))
+	headerSize := streamHeaderBaseSize + 17
+	chunk := 1024 + 16
+
+	flipped := append([]byte{}, data...)
+	flipped[headerSize+chunk+10] ^= 1
+	for name, data := range map[string][]byte{
+		"truncated at chunk":  data[:headerSize+2*chunk],
+		"truncated in chunk":  data[:len(data)-5],
+		"without chunks":      data[:headerSize],
+		"flipped bit":         flipped,
+		"dropped chunk":       append(append([]byte{}, data[:headerSize]...), data[headerSize+chunk:]...),
+		"swapped header byte": append([]byte("BPCRYPT1\x02"), data[9:]...),
+	} {
+		if _, err := decrypt(conf, data); err == nil {
+			t.Fatalf("Expected %s data to fail", name)
+		}
+	}
+	if _, err := decrypt(map[string]string{"passphrase": "wrong"}, data); err == nil {
+		t.Fatal("Expected wrong passphrase to fail")
+	}
+}
+
+func TestFilterDecryptWorkFactor(t *testing.T) {
+	data := encrypt(t, map[string]string{"passphrase": "secret", "work_factor": "12"}, []byte(expectedText))
+	// The work factor in the header is limited by the configured one
+	if _, err := decrypt(map[string]string{"passphrase": "secret", "work_factor": "10"}, data); err == nil {
+		t.Fatal("Expected work factor above work_factor to fail")
+	}
+	if _, err := decrypt(map[string]string{"passphrase": "secret"}, data); err != nil {
+		t.Fatal(err)
+	}
+	headerSize := streamHeaderBaseSize + 17
+	expensive := append([]byte{}, data...)
+	expensive[headerSize-1] = 30
+	if _, err := decrypt(map[string]string{"passphrase": "secret"}, expensive); err == nil {
+		t.Fatal("Expected work factor above the default to fail")
+	}
+}
+
+func TestFilterEncryptVault(t *testing.T) {
+	// Stand-in for the transit secrets engine, wrapping keys by xor
+	wrapKey := bytes.Repeat([]byte{0x42}, 32)
+	xor := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ wrapKey[i%len(wrapKey)]
+		}
+		return out
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		req := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/backup":
+			key := make([]byte, 32)
+			rand.Read(key)
+			fmt.Fprintf(w, `{"data": {"plaintext": %q, "ciphertext": "vault:v1:%s"}}`,
+				base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(xor(key)))
+		case "/v1/transit/decrypt/backup":
+			wrapped, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req["ciphertext"], "vault:v1:"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"data": {"plaintext": %q}}`, base64.StdEncoding.EncodeToString(xor(wrapped)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer ts.Close()
+
+	conf := map[string]string{"key_service": "vault", "vault_addr": ts.URL, "vault_token": "token", "vault_key": "backup"}
+	data := []byte(expectedText)
+	encrypted := encrypt(t, conf, data)
+	// Decrypting only needs access to Vault, the key name is stored
+	out, err := decrypt(map[string]string{"key_service": "vault", "vault_addr": ts.URL, "vault_token": "token"}, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("Unexpected output %q", out)
+	}
+	if _, err := decrypt(map[string]string{"key_service": "vault", "vault_addr": ts.URL, "vault_token": "wrong"}, encrypted); err == nil {
+		t.Fatal("Expected decryption without access to the key to fail")
+	}
+	if _, err := newKeySource(map[string]string{"key_service": "vault", "vault_addr": ts.URL}); err == nil && os.Getenv("VAULT_TOKEN") == "" {
+		t.Fatal("Expected key service without token to fail")
+	}
+
+	// The inverse keeps the token
+	inverse, err := filterInverseMap["encrypt"](conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inverse.Config["vault_token"] != "token" {
+		t.Fatalf("Unexpected inverse config %v", inverse.Config)
+	}
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	// OutputPolicyAll fails the run if any output fails.
+	OutputPolicyAll = "all"
+	// OutputPolicyAny fails the run only if all outputs fail.
+	OutputPolicyAny = "any"
+)
+
+// OutputResult describes what happened to a single output of a run.
+type OutputResult struct {
+	Name  string
+	Bytes int64
+	Err   error
+}
+
+// Result describes a pipeline run.
+type Result struct {
+	Bytes   int64 // Bytes read from the last stage
+	Outputs []OutputResult
+}
+
+type namedOutput struct {
+	name string
+	typ  string
+	output
+	retention   *retention
+	locationKey string
+	location    string // Expanded location
+}
+
+type sink struct {
+	namedOutput
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+// fanout writes everything to all outputs concurrently. Failed outputs
+// are dropped and, depending on the policy, fail the whole fanout.
+type fanout struct {
+	sinks  []*sink
+	policy string
+}
+
+func newFanout(outputs []namedOutput, policy string) *fanout {
+	f := &fanout{policy: policy}
+	for _, o := range outputs {
+		f.sinks = append(f.sinks, &sink{
+			namedOutput: o,
+			w:           bufio.NewWriterSize(o.output, *outputBuffer),
+		})
+	}
+	return f
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	f.each(func(s *sink) {
+		n, err := s.w.Write(p)
+		s.n += int64(n)
+		if err != nil {
+			s.err = fmt.Errorf("Couldn't write data: %s", err)
+		}
+	})
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close flushes and closes all outputs which didn't fail yet.
+func (f *fanout) Close() error {
+	f.each(func(s *sink) {
+		if err := s.w.Flush(); err != nil {
+			s.err = fmt.Errorf("Couldn't flush data: %s", err)
+			return
+		}
+		if err := s.output.Close(); err != nil {
+			s.err = fmt.Errorf("Couldn't close output: %s", err)
+		}
+	})
+	return f.check()
+}
+
+// each runs fn concurrently for every sink without error.
+func (f *fanout) each(fn func(s *sink)) {
+	var wg sync.WaitGroup
+	for _, s := range f.sinks {
+		if s.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *sink) {
+			defer wg.Done()
+			fn(s)
+			if s.err != nil {
+				log.Printf("Output %s failed: %s", s.name, s.err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (f *fanout) check() error {
+	failed := 0
+	for _, s := range f.sinks {
+		if s.err == nil {
+			continue
+		}
+		if f.policy != OutputPolicyAny {
+			return fmt.Errorf("Output %s failed: %s", s.name, s.err)
+		}
+		failed++
+	}
+	if failed == len(f.sinks) {
+		return errors.New("All outputs failed")
+	}
+	return nil
+}
+
+func (f *fanout) result(n int64) *Result {
+	r := &Result{Bytes: n}
+	for _, s := range f.sinks {
+		r.Outputs = append(r.Outputs, OutputResult{
+			Name:  s.name,
+			Bytes: s.n,
+			Err:   s.err,
+		})
+	}
+	return r
+}
@@ -2,20 +2,32 @@ package pipeline
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 )
 
 type fileInput struct {
-	filename string
+	*os.File
 }
 
 func init() {
 	inputMap["file"] = newFileInput
+	// Without path, so restores never overwrite the backed up file unless
+	// told to
+	inputInverseMap["file"] = inverseAs("file")
 }
 
 func newFileInput(conf map[string]string) (input, error) {
 	if conf["path"] == "" {
 		return nil, errors.New("path required")
 	}
-	return os.Open(conf["path"])
+	file, err := os.Open(conf["path"])
+	if err != nil {
+		return nil, err
+	}
+	return &fileInput{file}, nil
+}
+
+func (i *fileInput) readSidecar(suffix string) ([]byte, error) {
+	return ioutil.ReadFile(i.Name() + suffix)
 }
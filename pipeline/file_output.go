@@ -2,16 +2,94 @@ package pipeline
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 func init() {
 	outputMap["file"] = newFileOutput
+	outputInverseMap["file"] = inverseAs("file", "path")
+}
+
+// partialSuffix is the suffix of files still being written.
+const partialSuffix = ".partial"
+
+// fileOutput writes to a partial file next to path, so failed runs don't
+// leave truncated backups behind.
+type fileOutput struct {
+	*os.File
+	path string
+
+	mu      sync.Mutex // Protects renamed, Abort may run concurrently
+	renamed bool
 }
 
 func newFileOutput(conf map[string]string) (output, error) {
-	if conf["path"] == "" {
+	path := conf["path"]
+	if path == "" {
 		return nil, errors.New("path required")
 	}
-	return os.Create(conf["path"])
+	dir, name := filepath.Split(path)
+	file, err := os.Create(filepath.Join(dir, "."+name+partialSuffix))
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{File: file, path: path}, nil
+}
+
+// Close closes the partial file and renames it to path.
+func (o *fileOutput) Close() error {
+	if err := o.File.Close(); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := os.Rename(o.File.Name(), o.path); err != nil {
+		return err
+	}
+	o.renamed = true
+	return nil
+}
+
+// Abort closes and removes the partial file, or the file at path if it
+// was renamed already, since the run failed after all.
+func (o *fileOutput) Abort() error {
+	o.File.Close()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	name := o.File.Name()
+	if o.renamed {
+		name = o.path
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (o *fileOutput) locationKey() string { return "path" }
+
+func (o *fileOutput) list(prefix string) ([]backup, error) {
+	backups := []backup{}
+	err := filepath.Walk(filepath.Dir(prefix+"x"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(path, prefix) && !strings.HasSuffix(path, partialSuffix) {
+			backups = append(backups, backup{Name: path, Time: info.ModTime()})
+		}
+		return nil
+	})
+	return backups, err
+}
+
+func (o *fileOutput) remove(name string) error {
+	return os.Remove(name)
+}
+
+func (o *fileOutput) writeSidecar(suffix string, data []byte) error {
+	return ioutil.WriteFile(o.path+suffix, data, 0644)
 }
@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheDirSignature starts valid CACHEDIR.TAG files, see
+// https://bford.info/cachedir/
+const cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// fileSelector decides which files of a tree to archive.
+type fileSelector struct {
+	excludes      patternList
+	includes      patternList
+	markers       []string // Exclude directories containing any of these
+	excludeCaches bool
+	minSize       int64
+	maxSize       int64
+	newerThan     time.Time
+	olderThan     time.Time
+}
+
+// newFileSelector returns the selector configured by exclude,
+// exclude_file, include, exclude_if_present, exclude_caches, min_size,
+// max_size, newer_than and older_than.
+func newFileSelector(conf map[string]string) (*fileSelector, error) {
+	s := &fileSelector{}
+	var err error
+	if s.excludes, err = newPatternList(conf["exclude"], conf["exclude_file"]); err != nil {
+		return nil, fmt.Errorf("Invalid exclude: %s", err)
+	}
+	if s.includes, err = newPatternList(conf["include"], ""); err != nil {
+		return nil, fmt.Errorf("Invalid include: %s", err)
+	}
+	for _, marker := range strings.Split(conf["exclude_if_present"], ",") {
+		if marker = strings.TrimSpace(marker); marker != "" {
+			s.markers = append(s.markers, marker)
+		}
+	}
+	s.excludeCaches = conf["exclude_caches"] == "true"
+	for key, size := range map[string]*int64{"min_size": &s.minSize, "max_size": &s.maxSize} {
+		if conf[key] == "" {
+			continue
+		}
+		if *size, err = parseSize(conf[key]); err != nil {
+			return nil, fmt.Errorf("Invalid %s %s: %s", key, conf[key], err)
+		}
+	}
+	for key, t := range map[string]*time.Time{"newer_than": &s.newerThan, "older_than": &s.olderThan} {
+		if conf[key] == "" {
+			continue
+		}
+		if *t, err = parseTimeOrAge(conf[key]); err != nil {
+			return nil, fmt.Errorf("Invalid %s %s: %s", key, conf[key], err)
+		}
+	}
+	return s, nil
+}
+
+// skip returns true if the file at path, with name relative to the root
+// of the tree, isn't selected. Skipped directories aren't walked.
+func (s *fileSelector) skip(path, name string, info os.FileInfo) (bool, error) {
+	name = filepath.ToSlash(name)
+	if info.IsDir() {
+		if s.excludes.match(name, true) {
+			return true, nil
+		}
+		return s.hasMarker(path)
+	}
+	if s.excludes.match(name, false) {
+		return true, nil
+	}
+	if len(s.includes) > 0 && !s.includes.matchParents(name, false) {
+		return true, nil
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	switch {
+	case s.minSize > 0 && info.Size() < s.minSize,
+		s.maxSize > 0 && info.Size() > s.maxSize,
+		!s.newerThan.IsZero() && !info.ModTime().After(s.newerThan),
+		!s.olderThan.IsZero() && !info.ModTime().Before(s.olderThan):
+		return true, nil
+	}
+	return false, nil
+}
+
+// hasMarker returns true if the directory contains a marker file or a
+// valid CACHEDIR.TAG, if enabled.
+func (s *fileSelector) hasMarker(dir string) (bool, error) {
+	for _, marker := range s.markers {
+		if _, err := os.Lstat(filepath.Join(dir, marker)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if !s.excludeCaches {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "CACHEDIR.TAG"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(data, []byte(cacheDirSignature)), nil
+}
+
+// parseSize parses a size in bytes, with an optional suffix K, M, G or T
+// for powers of 1024.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i > 0 && i == len(s)-1 {
+		mult = 1 << (10 * uint(strings.IndexByte("KMGT", s[i])+1))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("must be bytes, optionally with suffix K, M, G or T")
+	}
+	return n * mult, nil
+}
+
+// parseTimeOrAge parses a RFC3339 time or an age like 24h, relative to
+// now.
+func parseTimeOrAge(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
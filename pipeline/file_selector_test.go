@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPatternList(t *testing.T) {
+	list, err := newPatternList("*.log, !keep.log, /build/, docs/**/*.tmp, cache/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		isDir    bool
+		expected bool
+	}{
+		{"app.log", false, true},
+		{"a/b/app.log", false, true},
+		{"a/keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"a/build", true, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"a/docs/x.tmp", false, false},
+		{"a/cache", true, true},
+		{"main.go", false, false},
+	} {
+		if got := list.match(tc.name, tc.isDir); got != tc.expected {
+			t.Errorf("match(%q, %t) = %t, expected %t", tc.name, tc.isDir, got, tc.expected)
+		}
+	}
+}
+
+func TestTarInputSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "data")
+	for name, content := range map[string]string{
+		"a.txt":                 "a",
+		"big.txt":               "0123456789",
+		"debug.log":             "log",
+		"sub/b.txt":             "b",
+		"sub/c.tmp":             "c",
+		"cache/CACHEDIR.TAG":    cacheDirSignature + "\n",
+		"cache/blob":            "x",
+		"skip/.nobackup":        "",
+		"skip/d.txt":            "d",
+		"node_modules/e/f.txt":  "f",
+		"node_modules/e/g.json": "g",
+	} {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Excluded directories are never read
+	if err := os.Chmod(filepath.Join(root, "node_modules"), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(root, "node_modules"), 0755)
+	excludeFile := filepath.Join(dir, "exclude")
+	if err := ioutil.WriteFile(excludeFile, []byte("# Build artifacts\n*.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := newTarInput(map[string]string{
+		"path":               root,
+		"exclude":            "*.log, node_modules/",
+		"exclude_file":       excludeFile,
+		"exclude_if_present": ".nobackup",
+		"exclude_caches":     "true",
+		"max_size":           "5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	tr := tar.NewReader(in)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"data", "data/a.txt", "data/sub", "data/sub/b.txt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Unexpected files %v, expected %v", names, expected)
+	}
+}
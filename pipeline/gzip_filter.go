@@ -2,41 +2,183 @@ package pipeline
 
 import (
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/pgzip"
+)
+
+const (
+	defaultGzipBlockSize = 1 * 1024 * 1024
+	minGzipBlockSize     = 64 * 1024 // Must be bigger than the dictionary
+
+	// rsyncMask defines the average size of members in rsyncable mode,
+	// 64KB.
+	rsyncMask = 1<<16 - 1
+	// rsyncMinSize is the minimum size of members in rsyncable mode, so
+	// data hitting the hash often doesn't compress badly. Same as the
+	// window of gzip --rsyncable.
+	rsyncMinSize = 4 * 1024
 )
 
 func init() {
 	filterMap["gzip"] = newGZipFilter
+	filterInverseMap["gzip"] = inverseAs("gunzip")
 }
 
-type gzipFilter struct {
-	r io.Reader
-}
+// newGZipFilter returns a gzip compressing filter. Options:
+// level (0-9), name, comment and mtime (RFC3339 or unix time) of the
+// header and rsyncable. Setting parallel to true, threads or block_size
+// compresses blocks of the data on multiple cores, like pigz. The output
+// is a regular gzip stream either way.
+func newGZipFilter(conf map[string]string) (filter, error) {
+	level := gzip.DefaultCompression
+	if conf["level"] != "" {
+		n, err := strconv.Atoi(conf["level"])
+		if err != nil || n < gzip.NoCompression || n > gzip.BestCompression {
+			return nil, fmt.Errorf("Invalid gzip level %s", conf["level"])
+		}
+		level = n
+	}
+	header := gzip.Header{
+		Name:    conf["name"],
+		Comment: conf["comment"],
+		OS:      255, // Unknown, the default of compress/gzip
+	}
+	if mtime := conf["mtime"]; mtime != "" {
+		t, err := time.Parse(time.RFC3339, mtime)
+		if err != nil {
+			sec, serr := strconv.ParseInt(mtime, 10, 64)
+			if serr != nil {
+				return nil, fmt.Errorf("Invalid mtime %s, must be RFC3339 or unix time", mtime)
+			}
+			t = time.Unix(sec, 0)
+		}
+		header.ModTime = t
+	}
+
+	parallel := conf["parallel"] == "true"
+	threads := runtime.NumCPU()
+	if conf["threads"] != "" {
+		n, err := strconv.Atoi(conf["threads"])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid number of threads %s", conf["threads"])
+		}
+		threads = n
+		parallel = true
+	}
+	blockSize := defaultGzipBlockSize
+	if conf["block_size"] != "" {
+		n, err := strconv.Atoi(conf["block_size"])
+		if err != nil || n < minGzipBlockSize {
+			return nil, fmt.Errorf("Invalid block size %s, must be at least %d", conf["block_size"], minGzipBlockSize)
+		}
+		blockSize = n
+		parallel = true
+	}
 
-func newGZipFilter(map[string]string) (filter, error) {
-	return &gzipFilter{}, nil
+	newWriter := func(w io.Writer) (io.WriteCloser, error) {
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Header = header
+		return zw, nil
+	}
+	if parallel {
+		newWriter = func(w io.Writer) (io.WriteCloser, error) {
+			zw, err := pgzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+			zw.Header = pgzip.Header(header)
+			return zw, zw.SetConcurrency(blockSize, threads)
+		}
+	}
+	if conf["rsyncable"] == "true" {
+		if parallel {
+			return nil, errors.New("rsyncable can't be combined with parallel compression")
+		}
+		return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return &rsyncableWriter{w: w, newMember: newWriter}, nil
+		}}, nil
+	}
+	return &compressFilter{newWriter: newWriter}, nil
 }
 
-func (f *gzipFilter) Link(r io.Reader) error {
-	pr, pw := io.Pipe()
-	f.r = pr
+// rsyncableWriter starts a new gzip member whenever a rolling hash of the
+// data hits, like pigz --rsyncable. Since the boundaries only depend on
+// the data, changes only affect the members containing them, so
+// consecutive backups of similar data share most of their output.
+type rsyncableWriter struct {
+	w         io.Writer
+	newMember func(w io.Writer) (io.WriteCloser, error)
+	zw        io.WriteCloser
+	hash      uint32
+	size      int // Of the data in the current member
+	started   bool
+}
 
-	zw := gzip.NewWriter(pw)
-	go func() {
-		defer zw.Close()
-		_, err := io.Copy(zw, r)
+func (r *rsyncableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		i, boundary := r.boundary(p)
+		if r.zw == nil {
+			zw, err := r.newMember(r.w)
+			if err != nil {
+				return written, err
+			}
+			r.zw = zw
+			r.started = true
+		}
+		n, err := r.zw.Write(p[:i])
+		written += n
 		if err != nil {
-			pr.CloseWithError(err)
-			pw.CloseWithError(err)
-			log.Print(err)
-			return
-		}
-		pw.Close()
-	}()
-	return nil
+			return written, err
+		}
+		p = p[i:]
+		if boundary {
+			err := r.zw.Close()
+			r.zw = nil
+			r.size = 0
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// boundary returns the length of p up to and including the next
+// boundary, or the length of p if there is none. Hits of the hash closer
+// than rsyncMinSize to the last boundary are ignored.
+func (r *rsyncableWriter) boundary(p []byte) (int, bool) {
+	for i, b := range p {
+		r.hash = ((r.hash << 1) ^ uint32(b)) & rsyncMask
+		r.size++
+		if r.hash == rsyncMask>>1 && r.size >= rsyncMinSize {
+			return i + 1, true
+		}
+	}
+	return len(p), false
 }
 
-func (f *gzipFilter) Read(p []byte) (n int, err error) {
-	return f.r.Read(p)
+// Close closes the current member. Without any data, an empty member is
+// written.
+func (r *rsyncableWriter) Close() error {
+	if r.zw == nil && !r.started {
+		zw, err := r.newMember(r.w)
+		if err != nil {
+			return err
+		}
+		r.zw = zw
+	}
+	if r.zw == nil {
+		return nil
+	}
+	return r.zw.Close()
 }
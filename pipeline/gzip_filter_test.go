@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFilterGZip(t *testing.T) {
+	in := bytes.NewBuffer([]byte("Hello World"))
+	out := &bytes.Buffer{}
+
+	gzip, err := newGZipFilter(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gzip.Link(in); err != nil {
+		t.Fatal(err)
+	}
+	gunzip, err := newGUnzipFilter(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gunzip.Link(gzip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, gunzip); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Hello World" {
+		t.Fatal("Unexpected: ", out.String())
+	}
+}
+
+func TestFilterGZipParallel(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World "), 100000)
+	gzip, err := newGZipFilter(map[string]string{"threads": "4", "block_size": "65536"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gzip.Link(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	gunzip, err := newGUnzipFilter(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gunzip.Link(gzip); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if _, err := io.Copy(out, gunzip); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("Unexpected output")
+	}
+}
+
+func TestFilterGZipHeader(t *testing.T) {
+	f, err := newGZipFilter(map[string]string{
+		"level":   "9",
+		"name":    "db.sql",
+		"comment": "nightly",
+		"mtime":   "2026-10-18T03:00:00Z",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Link(bytes.NewBufferString("Hello World")); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Name != "db.sql" || zr.Comment != "nightly" || !zr.ModTime.Equal(time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected header %#v", zr.Header)
+	}
+	if data, err := ioutil.ReadAll(zr); err != nil || string(data) != "Hello World" {
+		t.Fatalf("Unexpected data %q: %v", data, err)
+	}
+}
+
+func TestFilterGZipRsyncable(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	changed := append([]byte{}, data...)
+	changed[len(changed)/2] ^= 0xff
+
+	compress := func(data []byte) []byte {
+		f, err := newGZipFilter(map[string]string{"rsyncable": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Link(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	a, b := compress(data), compress(changed)
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(out, changed) {
+		t.Fatalf("Couldn't decompress rsyncable output: %v", err)
+	}
+	// Only the member with the change differs
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if differs := len(b) - prefix - suffix; differs > 1024*1024 {
+		t.Fatalf("Expected only a small part of the output to differ, %d of %d bytes do", differs, len(b))
+	}
+}
+
+// memberSizes records the sizes of the members written by rsyncableWriter.
+type memberSizes struct {
+	sizes []int
+}
+
+func (m *memberSizes) Write(p []byte) (int, error) {
+	m.sizes[len(m.sizes)-1] += len(p)
+	return len(p), nil
+}
+
+func (m *memberSizes) Close() error { return nil }
+
+func (m *memberSizes) newMember(w io.Writer) (io.WriteCloser, error) {
+	m.sizes = append(m.sizes, 0)
+	return m, nil
+}
+
+func TestFilterGZipRsyncableMembers(t *testing.T) {
+	random := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	// A pattern hitting the hash every 16 bytes
+	pattern := []byte{}
+	for len(pattern) == 0 {
+		r := &rsyncableWriter{}
+		for i := 0; i < 16; i++ {
+			r.boundary(random[i : i+1])
+		}
+		if r.hash == rsyncMask>>1 {
+			pattern = random[:16]
+		}
+		random = random[1:]
+	}
+
+	for name, tc := range map[string]struct {
+		data     []byte
+		min, max int // Of the average member size
+	}{
+		"random":  {random, 32 * 1024, 128 * 1024},
+		"pattern": {bytes.Repeat(pattern, 64*1024), rsyncMinSize, rsyncMinSize + 16},
+	} {
+		m := &memberSizes{}
+		r := &rsyncableWriter{newMember: m.newMember}
+		if _, err := r.Write(tc.data); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range m.sizes[:len(m.sizes)-1] {
+			if size < rsyncMinSize {
+				t.Fatalf("Member of %d bytes in %s data, expected at least %d", size, name, rsyncMinSize)
+			}
+		}
+		if avg := len(tc.data) / len(m.sizes); avg < tc.min || avg > tc.max {
+			t.Errorf("Unexpected average member size %d of %s data, expected %d to %d", avg, name, tc.min, tc.max)
+		}
+	}
+}
@@ -5,3 +5,10 @@ import "io"
 type input interface {
 	io.Reader
 }
+
+// sidecarReader is implemented by inputs reading a backup which might have
+// sidecar files next to it, like a checksum.
+type sidecarReader interface {
+	// readSidecar returns the content of the sidecar with given suffix.
+	readSidecar(suffix string) ([]byte, error)
+}
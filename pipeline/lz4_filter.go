@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func init() {
+	filterMap["lz4"] = newLz4Filter
+	filterInverseMap["lz4"] = inverseAs("unlz4")
+}
+
+// newLz4Filter returns a lz4 compressing filter. Options: level (0 for
+// fast, the default, up to 9) and threads.
+func newLz4Filter(conf map[string]string) (filter, error) {
+	opts := []lz4.Option{}
+	if level := conf["level"]; level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 9 {
+			return nil, fmt.Errorf("Invalid lz4 level %s", level)
+		}
+		l := lz4.Fast
+		if n > 0 {
+			l = lz4.Level1 << uint(n-1)
+		}
+		opts = append(opts, lz4.CompressionLevelOption(l))
+	}
+	if threads := conf["threads"]; threads != "" {
+		n, err := strconv.Atoi(threads)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid number of threads %s", threads)
+		}
+		opts = append(opts, lz4.ConcurrencyOption(n))
+	}
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		zw := lz4.NewWriter(w)
+		return zw, zw.Apply(opts...)
+	}}, nil
+}
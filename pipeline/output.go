@@ -5,3 +5,17 @@ import "io"
 type output interface {
 	io.WriteCloser
 }
+
+// locator is implemented by outputs writing to a location given in
+// their config, like a path.
+type locator interface {
+	// locationKey returns the config key holding the location.
+	locationKey() string
+}
+
+// sidecarWriter is implemented by outputs able to store sidecar files,
+// like a checksum, next to the backup.
+type sidecarWriter interface {
+	// writeSidecar stores the sidecar with given suffix.
+	writeSidecar(suffix string, data []byte) error
+}
@@ -0,0 +1,202 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pattern is a gitignore style pattern:
+//
+//   - Patterns without slash match the name at any depth, others are
+//     relative to the root, like foo/bar or /foo.
+//   - A trailing slash only matches directories.
+//   - * and ? don't match slashes, ** matches any number of directories.
+//   - A leading ! negates the pattern.
+type pattern struct {
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+func compilePattern(p string) (*pattern, error) {
+	pat := &pattern{}
+	if strings.HasPrefix(p, "!") {
+		pat.negate = true
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		pat.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("Invalid pattern %q", p)
+	}
+
+	re := &strings.Builder{}
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid pattern %q: unterminated [", p)
+			}
+			class := p[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(p):
+			i++
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	var err error
+	if pat.re, err = regexp.Compile(re.String()); err != nil {
+		return nil, fmt.Errorf("Invalid pattern %q: %s", p, err)
+	}
+	return pat, nil
+}
+
+func (p *pattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(name)
+}
+
+// patternList is a list of patterns, like a .gitignore file. The last
+// matching pattern decides.
+type patternList []*pattern
+
+// newPatternList compiles the comma separated patterns and those in the
+// given file, one per line. Empty lines and comments are ignored.
+func newPatternList(patterns, file string) (patternList, error) {
+	lines := strings.Split(patterns, ",")
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	list := patternList{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := compilePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// match returns true if the name, a slash separated path relative to the
+// root, matches the list.
+func (l patternList) match(name string, isDir bool) bool {
+	matched := false
+	for _, p := range l {
+		if p.match(name, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// matchParents returns true if the name or any of its parent directories
+// match the list.
+func (l patternList) matchParents(name string, isDir bool) bool {
+	for ; name != "." && name != "/" && name != ""; name, isDir = path.Dir(name), true {
+		if l.match(name, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// entrySelector selects entries of tar archives by the patterns in
+// include and exclude, matched against the names in the archive.
+type entrySelector struct {
+	includes patternList
+	excludes patternList
+}
+
+func newEntrySelector(conf map[string]string) (*entrySelector, error) {
+	s := &entrySelector{}
+	var err error
+	if s.excludes, err = newPatternList(conf["exclude"], conf["exclude_file"]); err != nil {
+		return nil, fmt.Errorf("Invalid exclude: %s", err)
+	}
+	if s.includes, err = newPatternList(conf["include"], ""); err != nil {
+		return nil, fmt.Errorf("Invalid include: %s", err)
+	}
+	return s, nil
+}
+
+// selected returns true if the entry is selected. Whiteouts are selected
+// by the name of the deleted file. Selecting a hardlink whose target
+// isn't selected fails, since the linked data would be missing.
+func (s *entrySelector) selected(hdr *tar.Header) (bool, error) {
+	name := entryName(hdr.Name)
+	if dir, file := path.Split(name); hdr.PAXRecords[whiteoutRecord] == "1" {
+		name = dir + strings.TrimPrefix(file, whiteoutPrefix)
+	}
+	if !s.selectedName(name, hdr.Typeflag == tar.TypeDir) {
+		return false, nil
+	}
+	if hdr.Typeflag == tar.TypeLink && !s.selectedName(entryName(hdr.Linkname), false) {
+		return false, fmt.Errorf("Hardlink %s to %s selected without its target", hdr.Name, hdr.Linkname)
+	}
+	return true, nil
+}
+
+func (s *entrySelector) selectedName(name string, isDir bool) bool {
+	if name == "" {
+		return true
+	}
+	if s.excludes.matchParents(name, isDir) {
+		return false
+	}
+	return len(s.includes) == 0 || s.includes.matchParents(name, isDir)
+}
+
+// entryName returns the cleaned name of a tar entry, without leading
+// slash.
+func entryName(name string) string {
+	return strings.TrimLeft(path.Clean("/"+name), "/")
+}
@@ -3,15 +3,43 @@ package pipeline
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 
 	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
 )
 
 func init() {
 	filterMap["pgp"] = newPGPFilter
+	filterInverseMap["pgp"] = inversePGP
+}
+
+// inversePGP returns the unpgp config, trusting the public key of the
+// signkey, if any.
+func inversePGP(conf map[string]string) (commonConfig, error) {
+	c, _ := inverseAs("unpgp")(conf)
+	keyRing, err := readKeyRing(conf, "signkey")
+	if err != nil || keyRing == nil {
+		return c, err
+	}
+	signer, err := readSignKey(keyRing, nil)
+	if err != nil {
+		return c, err
+	}
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return c, err
+	}
+	if err := signer.Serialize(w); err != nil {
+		return c, err
+	}
+	if err := w.Close(); err != nil {
+		return c, err
+	}
+	c.Config["trusted_keys"] = buf.String()
+	return c, nil
 }
 
 type pgpFilter struct {
@@ -21,28 +49,63 @@ type pgpFilter struct {
 	ready chan bool
 }
 
+// newPGPFilter returns a filter encrypting to the keys in pubkey and
+// pubkey_file, or those of them selected by recipients. Without keys, the
+// data is encrypted symmetrically with the passphrase.
 func newPGPFilter(conf map[string]string) (filter, error) {
-	if conf["pubkey"] == "" {
-		return nil, errors.New("pubkey required")
+	keyRing, err := readKeyRing(conf, "pubkey")
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(conf, "passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if keyRing == nil && passphrase == nil {
+		return nil, errors.New("pubkey, pubkey_file or passphrase required")
 	}
-	to, err := openpgp.ReadArmoredKeyRing(bytes.NewBuffer([]byte(conf["pubkey"])))
+	to, err := selectKeys(keyRing, conf["recipients"])
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read pubkey: %s", err)
+		return nil, err
+	}
+	var signer *openpgp.Entity
+	signKeyRing, err := readKeyRing(conf, "signkey")
+	if err != nil {
+		return nil, err
+	}
+	if signKeyRing != nil {
+		if keyRing == nil {
+			return nil, errors.New("Symmetric encryption doesn't support signing")
+		}
+		signPassphrase, err := readPassphrase(conf, "signkey_passphrase")
+		if err != nil {
+			return nil, err
+		}
+		if signer, err = readSignKey(signKeyRing, signPassphrase); err != nil {
+			return nil, err
+		}
 	}
 
 	pr, pw := io.Pipe()
 	f := &pgpFilter{
 		r:     pr,
 		pw:    pw,
-		ready: make(chan bool),
+		ready: make(chan bool, 1),
 	}
 	go func() {
-		w, err := openpgp.Encrypt(pw, to, nil, nil, nil) // Not signing yet, sorry
+		var (
+			w   io.WriteCloser
+			err error
+		)
+		if keyRing == nil {
+			w, err = openpgp.SymmetricallyEncrypt(pw, passphrase, nil, nil)
+		} else {
+			w, err = openpgp.Encrypt(pw, to, signer, nil, nil)
+		}
 		f.pgpw = w
 		f.ready <- true
 		if err != nil {
-			pr.CloseWithError(err)
-			pw.CloseWithError(err)
+			pw.CloseWithError(err) // Readers get the error
 			return
 		}
 		log.Print("enc returned")
@@ -56,11 +119,16 @@ func (f *pgpFilter) Link(r io.Reader) error {
 		// so we need to wait for it before we can read from
 		// the writher
 		<-f.ready
-		defer f.pw.Close()
-		defer f.pgpw.Close()
-		if _, err := io.Copy(f.pgpw, r); err != nil {
-			f.r.CloseWithError(err)
-			f.pw.CloseWithError(err)
+		if f.pgpw == nil {
+			return // Encrypt failed and closed the pipe already
+		}
+		_, err := io.Copy(f.pgpw, r)
+		if err == nil {
+			err = f.pgpw.Close()
+		}
+		f.pw.CloseWithError(err)
+		if err != nil {
+			log.Print(err)
 			return
 		}
 		log.Print("Finished filter")
@@ -68,6 +136,11 @@ func (f *pgpFilter) Link(r io.Reader) error {
 	return nil
 }
 
+// Abort closes the pipe, which stops the encryption.
+func (f *pgpFilter) Abort() error {
+	return f.r.CloseWithError(errAborted)
+}
+
 func (f *pgpFilter) Read(p []byte) (n int, err error) {
 	log.Print("read")
 	return f.r.Read(p)
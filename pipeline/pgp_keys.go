@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// minKeyIdLength is the minimum number of hex digits of a fingerprint to
+// select a key by, as in short key ids.
+const minKeyIdLength = 8
+
+// readKeyRing returns the keys given armored in conf[name] and in the
+// file conf[name+"_file"], which may be an armored or binary key ring,
+// like exported by gpg. It returns nil if neither is set.
+func readKeyRing(conf map[string]string, name string) (openpgp.EntityList, error) {
+	var keyRing openpgp.EntityList
+	if conf[name] != "" {
+		keys, err := parseKeyRing([]byte(conf[name]))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s: %s", name, err)
+		}
+		keyRing = append(keyRing, keys...)
+	}
+	if file := conf[name+"_file"]; file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s_file: %s", name, err)
+		}
+		keys, err := parseKeyRing(data)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s: %s", file, err)
+		}
+		keyRing = append(keyRing, keys...)
+	}
+	return keyRing, nil
+}
+
+func parseKeyRing(data []byte) (openpgp.EntityList, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// selectKeys returns the keys matching the comma separated selectors,
+// which are fingerprints, key ids or email addresses. Without selectors,
+// all keys are returned.
+func selectKeys(keyRing openpgp.EntityList, selectors string) (openpgp.EntityList, error) {
+	if strings.TrimSpace(selectors) == "" {
+		return keyRing, nil
+	}
+	selected := openpgp.EntityList{}
+	for _, selector := range strings.Split(selectors, ",") {
+		selector = strings.TrimSpace(selector)
+		found := false
+		for _, e := range keyRing {
+			if matchKey(e, selector) {
+				selected = append(selected, e)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No key found for recipient %s", selector)
+		}
+	}
+	return selected, nil
+}
+
+// matchKey returns true if the selector is an email address of the
+// entity, or the end of the fingerprint of its primary key or a subkey.
+func matchKey(e *openpgp.Entity, selector string) bool {
+	if strings.Contains(selector, "@") {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, selector) {
+				return true
+			}
+		}
+		return false
+	}
+	id := strings.ToLower(strings.Replace(strings.TrimPrefix(selector, "0x"), " ", "", -1))
+	if len(id) < minKeyIdLength {
+		return false
+	}
+	fingerprints := [][20]byte{e.PrimaryKey.Fingerprint}
+	for _, subkey := range e.Subkeys {
+		fingerprints = append(fingerprints, subkey.PublicKey.Fingerprint)
+	}
+	for _, fp := range fingerprints {
+		if strings.HasSuffix(hex.EncodeToString(fp[:]), id) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSignKey returns the first entity with a private key of the key
+// ring. If passphrase isn't nil, encrypted keys get decrypted with it.
+func readSignKey(keyRing openpgp.EntityList, passphrase []byte) (*openpgp.Entity, error) {
+	for _, e := range keyRing {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if passphrase != nil {
+			if err := decryptEntity(e, passphrase); err != nil {
+				return nil, fmt.Errorf("Couldn't decrypt signkey: %s", err)
+			}
+		}
+		return e, nil
+	}
+	return nil, errors.New("signkey contains no private key")
+}
+
+// decryptEntity decrypts the private keys of the entity which are
+// encrypted.
+func decryptEntity(e *openpgp.Entity, passphrase []byte) error {
+	if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+		if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPassphrase returns the passphrase given in conf[name], the file
+// conf[name+"_file"] or the environment variable conf[name+"_env"], nil
+// if none is set.
+func readPassphrase(conf map[string]string, name string) ([]byte, error) {
+	switch {
+	case conf[name] != "":
+		return []byte(conf[name]), nil
+	case conf[name+"_file"] != "":
+		data, err := ioutil.ReadFile(conf[name+"_file"])
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s_file: %s", name, err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	case conf[name+"_env"] != "":
+		passphrase := os.Getenv(conf[name+"_env"])
+		if passphrase == "" {
+			return nil, fmt.Errorf("Environment variable %s of %s_env is empty", conf[name+"_env"], name)
+		}
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
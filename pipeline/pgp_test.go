@@ -2,12 +2,19 @@ package pipeline
 
 import (
 	"bytes"
+	"crypto"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
 )
 
 const tempPrefix = "byte-piper-test"
@@ -151,6 +158,230 @@ func TestPGP(t *testing.T) {
 	}
 }
 
+func TestPGPSigned(t *testing.T) {
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	otherKey := buf.String()
+
+	for _, test := range []struct {
+		signkey, trusted string
+		fail             bool
+	}{
+		{privatKey, pubKey, false},
+		{privatKey, otherKey, true}, // Untrusted signer
+		{"", pubKey, true},          // Unsigned
+	} {
+		pgp, err := newPGPFilter(map[string]string{"pubkey": pubKey, "signkey": test.signkey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pgp.Link(bytes.NewBufferString(expectedText)); err != nil {
+			t.Fatal(err)
+		}
+		unpgp, err := newUnpgpFilter(map[string]string{"privatkey": privatKey, "trusted_keys": test.trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unpgp.Link(pgp); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(unpgp)
+		if test.fail {
+			if err == nil {
+				t.Fatalf("Expected verification to fail for %#v", test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expectedText {
+			t.Fatal("Unexpected string ", string(out))
+		}
+	}
+}
+
+func TestPGPInverseTrustsSignKey(t *testing.T) {
+	c, err := inversePGP(map[string]string{"pubkey": pubKey, "signkey": privatKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := openpgp.ReadArmoredKeyRing(strings.NewReader(c.Config["trusted_keys"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trusted) != 1 || trusted[0].PrivateKey != nil {
+		t.Fatalf("Expected the public signkey to be trusted, got %#v", trusted)
+	}
+}
+
+func TestPGPRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pubKeys := &bytes.Buffer{}
+	privateKeyFiles := []string{}
+	for _, name := range []string{"oncall", "escrow", "other"} {
+		// Without preferred hash, encrypting needs RIPEMD160
+		e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		private := &bytes.Buffer{}
+		if err := e.SerializePrivate(private, nil); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name+".gpg")
+		if err := ioutil.WriteFile(file, private.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		privateKeyFiles = append(privateKeyFiles, file)
+		if err := e.Serialize(pubKeys); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyRingFile := filepath.Join(dir, "pubring.gpg")
+	if err := ioutil.WriteFile(keyRingFile, pubKeys.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyRing, err := readKeyRing(map[string]string{"pubkey_file": keyRingFile}, "pubkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrow := fmt.Sprintf("%X", keyRing[1].PrimaryKey.Fingerprint[:])
+
+	for i, file := range privateKeyFiles {
+		pgp, err := newPGPFilter(map[string]string{
+			"pubkey_file": keyRingFile,
+			"recipients":  "oncall@example.com, " + escrow,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pgp.Link(bytes.NewBufferString(expectedText)); err != nil {
+			t.Fatal(err)
+		}
+		unpgp, err := newUnpgpFilter(map[string]string{"privatkey_file": file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = unpgp.Link(pgp)
+		if i == 2 { // other isn't a recipient
+			if err == nil {
+				t.Fatal("Expected decryption with key of non-recipient to fail")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(unpgp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expectedText {
+			t.Fatal("Unexpected string ", string(out))
+		}
+	}
+
+	if _, err := newPGPFilter(map[string]string{"pubkey_file": keyRingFile, "recipients": "unknown@example.com"}); err == nil {
+		t.Fatal("Expected unknown recipient to fail")
+	}
+}
+
+func TestPGPPassphrase(t *testing.T) {
+	// Encrypted with the passphrase by gpg -c
+	symmetric, err := os.Open("fixtures/symmetric.gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer symmetric.Close()
+	os.Setenv("BYTE_PIPER_TEST_PASSPHRASE", "secret")
+	defer os.Unsetenv("BYTE_PIPER_TEST_PASSPHRASE")
+	unpgp, err := newUnpgpFilter(map[string]string{"passphrase_env": "BYTE_PIPER_TEST_PASSPHRASE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unpgp.Link(symmetric); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(unpgp); err != nil || string(out) != "Hello World\n" {
+		t.Fatalf("Unexpected string %q: %v", out, err)
+	}
+
+	// Private key protected by the passphrase, exported by gpg
+	for passphrase, fail := range map[string]bool{"secret": false, "wrong": true} {
+		keyRing, err := readKeyRing(map[string]string{"pubkey_file": "fixtures/encrypted-key.asc"}, "pubkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pgp, err := newPGPFilter(map[string]string{"pubkey_file": "fixtures/encrypted-key.asc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pgp.Link(bytes.NewBufferString(expectedText)); err != nil {
+			t.Fatal(err)
+		}
+		if !keyRing[0].PrivateKey.Encrypted {
+			t.Fatal("Expected fixture key to be encrypted")
+		}
+		unpgp, err := newUnpgpFilter(map[string]string{
+			"privatkey_file": "fixtures/encrypted-key.asc",
+			"passphrase":     passphrase,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = unpgp.Link(pgp)
+		if fail {
+			if err == nil {
+				t.Fatal("Expected wrong passphrase to fail")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := ioutil.ReadAll(unpgp); err != nil || string(out) != expectedText {
+			t.Fatalf("Unexpected string %q: %v", out, err)
+		}
+	}
+}
+
+func TestPGPSymmetric(t *testing.T) {
+	pgp, err := newPGPFilter(map[string]string{"passphrase": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pgp.Link(bytes.NewBufferString(expectedText)); err != nil {
+		t.Fatal(err)
+	}
+	unpgp, err := newUnpgpFilter(map[string]string{"passphrase": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unpgp.Link(pgp); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(unpgp); err != nil || string(out) != expectedText {
+		t.Fatalf("Unexpected string %q: %v", out, err)
+	}
+}
+
 func TestPGPforGPG(t *testing.T) {
 	in := bytes.NewBuffer([]byte(expectedText))
 
@@ -1,8 +1,11 @@
 package pipeline
 
 import (
-	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +13,8 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultOutputBuffer = 1 * 1024 * 1024
@@ -20,12 +25,53 @@ var (
 	outputMap = make(map[string]func(conf map[string]string) (output, error))
 
 	outputBuffer = flag.Int("b", defaultOutputBuffer, "Size of output buffer")
+
+	errAborted = errors.New("Pipeline aborted")
 )
 
+// waiter is implemented by inputs and filters doing work in the
+// background. Wait is called once all data was read and returns the
+// error of the background work, if any.
+type waiter interface {
+	Wait() error
+}
+
+// aborter is implemented by stages holding processes, pipes or uploads
+// which need to be torn down if a run fails or gets canceled. Abort may
+// be called concurrently with all other methods.
+type aborter interface {
+	Abort() error
+}
+
+// committer is implemented by inputs keeping state between runs, like
+// the snapshot of incremental tar backups. commit is called once the
+// backup succeeded.
+type committer interface {
+	commit() error
+}
+
+// leveler is implemented by inputs making incremental backups.
+type leveler interface {
+	// backupLevel returns 0 for full backups. Others need the latest
+	// previous backup with a lower level to be restored first.
+	backupLevel() int
+	// incremental returns true if backups can depend on previous ones.
+	incremental() bool
+}
+
 type Pipeline struct {
-	input   input
-	filters []filter
-	output  output
+	vars       *Vars
+	input      input
+	filters    []filter
+	outputs    []namedOutput
+	policy     string
+	timeout    time.Duration
+	abortOnce  sync.Once
+	catalog    string
+	configHash string
+	stages     []string
+	level      int
+	chained    bool // Backups can depend on previous ones
 }
 
 type commonConfig struct {
@@ -34,18 +80,49 @@ type commonConfig struct {
 }
 
 type config struct {
-	Input   commonConfig `json:"input"`
-	Filters filterConfig `json:"filters"`
-	Output  commonConfig `json:"output"`
+	Name         string         `json:"name"`
+	Input        commonConfig   `json:"input"`
+	Filters      filterConfig   `json:"filters"`
+	Output       outputConfig   `json:"output"`
+	Outputs      []outputConfig `json:"outputs"`
+	OutputPolicy string         `json:"output_policy"`
+	Timeout      string         `json:"timeout"`
+	Schedule     string         `json:"schedule"`
+	Jitter       string         `json:"jitter"`
+	Locks        []string       `json:"locks"`
+	Catalog      string         `json:"catalog"`
+
+	hash string // sha256 of the config file
+}
+
+type outputConfig struct {
+	commonConfig
+	Name string `json:"name"`
 }
 
 type filterConfig struct {
 	commonConfig
-	Next json.RawMessage `json:"next"`
+	Next json.RawMessage `json:"next,omitempty"`
 }
 
-// New returns a new pipeline.
-func New(configFile string) (*Pipeline, error) {
+// list returns the chained filter configs in order.
+func (f *filterConfig) list() ([]commonConfig, error) {
+	filters := []commonConfig{}
+	for f.Type != "" {
+		filters = append(filters, f.commonConfig)
+		if f.Next == nil {
+			break
+		}
+		next := &filterConfig{}
+		if err := json.Unmarshal(f.Next, next); err != nil {
+			return nil, fmt.Errorf("Couldn't unmarshal %s: %s", f.Next, err)
+		}
+		f = next
+	}
+	return filters, nil
+}
+
+func readConfig(configFile string) (*config, error) {
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return nil, err
@@ -54,88 +131,421 @@ func New(configFile string) (*Pipeline, error) {
 	if err := json.Unmarshal(data, conf); err != nil {
 		return nil, err
 	}
+	hash := sha256.Sum256(data)
+	conf.hash = hex.EncodeToString(hash[:])
+	if conf.Name == "" {
+		conf.Name = nameFromPath(configFile)
+	}
+	return conf, nil
+}
+
+// New returns a new pipeline. Config values are expanded as templates,
+// see Vars.
+func New(configFile string) (*Pipeline, error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return newFromConfig(conf)
+}
+
+func newFromConfig(conf *config) (*Pipeline, error) {
+	var (
+		timeout time.Duration
+		err     error
+	)
+	if conf.Timeout != "" {
+		if timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, fmt.Errorf("Invalid timeout %s: %s", conf.Timeout, err)
+		}
+	}
+	vars, err := newVars(conf.Name)
+	if err != nil {
+		return nil, err
+	}
 	inputNew, ok := inputMap[conf.Input.Type]
 	if !ok {
 		return nil, fmt.Errorf("Invalid input type %s", conf.Input.Type)
 	}
-	input, err := inputNew(mergeEnv("INPUT_", conf.Input.Config))
+	inputConf, err := vars.expand(mergeEnv("INPUT_", conf.Input.Config))
 	if err != nil {
 		return nil, err
 	}
-	outputNew, ok := outputMap[conf.Output.Type]
-	if !ok {
-		return nil, fmt.Errorf("Invalid output type %s", conf.Output.Type)
-	}
-	output, err := outputNew(mergeEnv("OUTPUT_", conf.Output.Config))
+	input, err := inputNew(inputConf)
 	if err != nil {
 		return nil, err
 	}
 	p := &Pipeline{
-		input:  input,
-		output: output,
+		vars:       vars,
+		input:      input,
+		policy:     conf.OutputPolicy,
+		timeout:    timeout,
+		catalog:    conf.Catalog,
+		configHash: conf.hash,
+		stages:     []string{conf.Input.Type},
+	}
+	if l, ok := input.(leveler); ok {
+		p.level = l.backupLevel()
+		p.chained = l.incremental()
+	}
+	switch p.policy {
+	case "":
+		p.policy = OutputPolicyAll
+	case OutputPolicyAll, OutputPolicyAny:
+	default:
+		return nil, fmt.Errorf("Invalid output policy %s", p.policy)
 	}
 
-	filterConf := &conf.Filters
-	prefix := "FILTER_"
-	for {
-		if filterConf.Type == "" {
-			break
+	outputConfs := conf.Outputs
+	if conf.Output.Type != "" {
+		if len(outputConfs) > 0 {
+			return nil, errors.New("Specify either output or outputs")
+		}
+		outputConfs = []outputConfig{conf.Output}
+	}
+	if len(outputConfs) == 0 {
+		return nil, errors.New("No output specified")
+	}
+	names := make(map[string]bool)
+	for i, oc := range outputConfs {
+		outputNew, ok := outputMap[oc.Type]
+		if !ok {
+			return nil, fmt.Errorf("Invalid output type %s", oc.Type)
 		}
+		name := oc.Name
+		if name == "" {
+			name = oc.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate output name %s, please set a name", name)
+		}
+		names[name] = true
+
+		prefix := "OUTPUT_"
+		if len(conf.Outputs) > 0 {
+			prefix = fmt.Sprintf("OUTPUT_%d_", i)
+		}
+		rawConf := mergeEnv(prefix, oc.Config)
+		outputConf, err := vars.expand(rawConf)
+		if err != nil {
+			return nil, err
+		}
+		output, err := outputNew(outputConf)
+		if err != nil {
+			return nil, err
+		}
+		no := namedOutput{name: name, typ: oc.Type, output: output}
+		if l, ok := output.(locator); ok {
+			no.locationKey = l.locationKey()
+			no.location = outputConf[no.locationKey]
+		}
+		if _, ok := output.(pruner); ok {
+			if no.retention, err = newRetention(rawConf, rawConf[no.locationKey], vars); err != nil {
+				return nil, fmt.Errorf("Invalid retention for output %s: %s", name, err)
+			}
+		} else if r, _ := newRetention(rawConf, "", vars); r != nil {
+			return nil, fmt.Errorf("Output %s doesn't support retention", name)
+		}
+		if no.retention != nil && p.chained && p.catalog == "" {
+			return nil, fmt.Errorf("Retention for output %s needs a catalog, to keep the backups incremental ones depend on", name)
+		}
+		p.outputs = append(p.outputs, no)
+	}
+
+	filterConfs, err := conf.Filters.list()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "FILTER_"
+	for _, filterConf := range filterConfs {
 		log.Printf("Filter %s", filterConf.Type)
 		filterNew, ok := filterMap[filterConf.Type]
 		if !ok {
 			return nil, fmt.Errorf("Unknown filter %s", filterConf.Type)
 		}
-		filter, err := filterNew(mergeEnv(prefix, filterConf.Config))
+		fc, err := vars.expand(mergeEnv(prefix, filterConf.Config))
+		if err != nil {
+			return nil, err
+		}
+		filter, err := filterNew(fc)
 		if err != nil {
 			return nil, err
 		}
 		p.filters = append(p.filters, filter)
-		if filterConf.Next == nil {
-			break
+		p.stages = append(p.stages, filterConf.Type)
+		prefix = prefix + "FILTER_"
+	}
+	if err := p.readDigests(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readDigests passes the digests stored next to the backup read by the
+// input to all filters verifying them.
+func (p *Pipeline) readDigests() error {
+	for i, f := range p.filters {
+		v, ok := f.(verifier)
+		if !ok || v.sidecarSuffix() == "" {
+			continue
 		}
-		fc := &filterConfig{}
-		if err := json.Unmarshal(filterConf.Next, fc); err != nil {
-			return nil, fmt.Errorf("Couldn't unmarshal %s: %s", filterConf.Next, err)
+		sr, ok := p.input.(sidecarReader)
+		if !ok {
+			return fmt.Errorf("Filter %d needs a checksum, but input doesn't support sidecars", i)
 		}
-		filterConf = fc
-		prefix = prefix + "FILTER_"
+		data, err := sr.readSidecar(v.sidecarSuffix())
+		if err != nil {
+			return fmt.Errorf("Couldn't read %s sidecar: %s", v.sidecarSuffix(), err)
+		}
+		sum, err := parseSidecar(data)
+		if err != nil {
+			return fmt.Errorf("Invalid %s sidecar: %s", v.sidecarSuffix(), err)
+		}
+		v.setExpected(sum)
+	}
+	return nil
+}
 
+// Timeout returns the configured timeout for a run, 0 if none is set.
+func (p *Pipeline) Timeout() time.Duration {
+	return p.timeout
+}
+
+// Run starts the pipeline and waits for it to finish.
+func (p *Pipeline) Run() (*Result, error) {
+	return p.RunContext(context.Background())
+}
+
+// RunContext starts the pipeline. If the context gets canceled, or the
+// run fails, all stages get aborted: Commands are killed, pipes closed
+// and uploads aborted.
+func (p *Pipeline) RunContext(ctx context.Context) (*Result, error) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("Aborting pipeline: %s", ctx.Err())
+			p.abort()
+		case <-done:
+		}
+	}()
+	result, err := p.run()
+	close(done)
+	if err == nil {
+		// Nothing left to abort, except outputs dropped by the policy
+		p.abortOnce.Do(func() { p.abortFailed(result) })
+		return result, nil
 	}
-	return p, nil
+	p.abort()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("Pipeline canceled (%s): %s", ctx.Err(), err)
+	}
+	return result, err
 }
 
-// Run starts the pipeline.
-func (p *Pipeline) Run() (int64, error) {
+// run starts the pipeline. All outputs receive the data concurrently.
+// The outputs are only closed if all inputs and filters succeeded.
+func (p *Pipeline) run() (*Result, error) {
+	start := time.Now()
 	last := p.input
 	for _, f := range p.filters {
 		log.Printf("Link %v -> %v", last, f)
 		if err := f.Link(last); err != nil {
-			return 0, err
+			return &Result{}, p.fail(err)
 		}
 		last = f
 	}
-	buf := bufio.NewWriterSize(p.output, *outputBuffer)
-	n, err := io.Copy(buf, last)
+	fo := newFanout(p.outputs, p.policy)
+	hash := sha256.New()
+	n, err := io.Copy(fo, io.TeeReader(last, hash))
 	if err != nil {
-		return n, fmt.Errorf("Couldn't pipe data: %s", err)
+		return fo.result(n), p.fail(fmt.Errorf("Couldn't pipe data: %s", err))
 	}
 	log.Print("copied")
-	if err := buf.Flush(); err != nil {
-		return n, fmt.Errorf("Couldn't flush data: %s", err)
+	if err := p.wait(); err != nil {
+		return fo.result(n), err
 	}
-	log.Print("flushed")
-	if err := p.output.Close(); err != nil {
-		return n, fmt.Errorf("Couldn't close pipeline: %s", err)
+	log.Print("finished")
+	if err := fo.Close(); err != nil {
+		return fo.result(n), fmt.Errorf("Couldn't close pipeline: %s", err)
 	}
 	log.Print("closed")
-	return n, nil
+	if err := p.writeDigests(fo); err != nil {
+		return fo.result(n), err
+	}
+	if p.catalog != "" {
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		end := time.Now()
+		for _, s := range fo.sinks {
+			if s.err != nil {
+				continue
+			}
+			if err := writeManifest(p.catalog, p.manifest(s, checksum, start, end)); err != nil {
+				return fo.result(n), fmt.Errorf("Couldn't write manifest: %s", err)
+			}
+		}
+	}
+	if c, ok := p.input.(committer); ok {
+		if err := c.commit(); err != nil {
+			return fo.result(n), fmt.Errorf("Couldn't commit input: %s", err)
+		}
+	}
+	p.prune(fo)
+	return fo.result(n), nil
+}
+
+// writeDigests stores the digests calculated by filters as sidecars of
+// all outputs which succeeded and support them.
+func (p *Pipeline) writeDigests(fo *fanout) error {
+	for _, f := range p.filters {
+		d, ok := f.(digester)
+		if !ok {
+			continue
+		}
+		suffix, sum := d.digest()
+		if sum == nil {
+			continue
+		}
+		for _, s := range fo.sinks {
+			sw, ok := s.output.(sidecarWriter)
+			if s.err != nil || !ok {
+				continue
+			}
+			if err := sw.writeSidecar(suffix, formatSidecar(sum, s.location)); err != nil {
+				return fmt.Errorf("Couldn't write %s sidecar of output %s: %s", suffix, s.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// prune applies the retention policies of all outputs which succeeded.
+// Errors are only logged, since the backup itself succeeded.
+func (p *Pipeline) prune(fo *fanout) {
+	var manifests []*Manifest
+	if p.catalog != "" {
+		var err error
+		if manifests, err = ReadCatalog(p.catalog, p.vars.Name); err != nil {
+			log.Printf("ERROR pruning: Couldn't read catalog: %s", err)
+			return
+		}
+	}
+	for _, s := range fo.sinks {
+		if s.err != nil || s.retention == nil {
+			continue
+		}
+		// The levels of the backups keep the chains they're part of
+		levels := map[string]int{s.location: p.level}
+		for _, m := range manifests {
+			if m.Output == s.name {
+				levels[m.Location] = m.Level
+			}
+		}
+		pruned, err := s.retention.prune(s.output.(pruner), s.location, levels)
+		if err != nil {
+			log.Printf("ERROR pruning output %s: %s", s.name, err)
+		}
+		// Manifests of pruned backups would offer them for restoring
+		for _, name := range pruned {
+			for _, m := range manifests {
+				if m.Output != s.name || m.Location != name {
+					continue
+				}
+				if err := os.Remove(manifestPath(p.catalog, m)); err != nil {
+					log.Printf("ERROR pruning manifest of %s: %s", name, err)
+				}
+			}
+		}
+	}
+}
+
+// fail aborts and waits for all stages after the run failed with err.
+// Stages may block writing to the failed one, so they're aborted before
+// waiting. The error of a stage which failed by itself, like the exit
+// status of a command, explains the failure best.
+func (p *Pipeline) fail(err error) error {
+	p.abort()
+	if werr := p.wait(); werr != nil && werr != errAborted {
+		return werr
+	}
+	return err
+}
+
+// wait waits for all stages doing background work and returns the
+// first error, errAborted only if all failed stages were aborted. Outputs
+// are closed by the fanout.
+func (p *Pipeline) wait() error {
+	var firstErr error
+	setErr := func(stage string, err error) {
+		if err == errAborted {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		err = fmt.Errorf("%s failed: %s", stage, err)
+		log.Print(err)
+		if firstErr == nil || firstErr == errAborted {
+			firstErr = err
+		}
+	}
+	if w, ok := p.input.(waiter); ok {
+		if err := w.Wait(); err != nil {
+			setErr("Input", err)
+		}
+	}
+	for i, f := range p.filters {
+		if w, ok := f.(waiter); ok {
+			if err := w.Wait(); err != nil {
+				setErr(fmt.Sprintf("Filter %d", i), err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// abortFailed aborts the outputs which failed in a successful run, so
+// they clean up partial uploads and files.
+func (p *Pipeline) abortFailed(result *Result) {
+	for i, o := range result.Outputs {
+		if o.Err == nil {
+			continue
+		}
+		if a, ok := p.outputs[i].output.(aborter); ok {
+			if err := a.Abort(); err != nil {
+				log.Printf("Couldn't abort output %s: %s", o.Name, err)
+			}
+		}
+	}
+}
+
+// abort aborts all stages, once.
+func (p *Pipeline) abort() {
+	p.abortOnce.Do(func() {
+		stages := []interface{}{p.input}
+		for _, f := range p.filters {
+			stages = append(stages, f)
+		}
+		for _, o := range p.outputs {
+			stages = append(stages, o.output)
+		}
+		for _, s := range stages {
+			if a, ok := s.(aborter); ok {
+				if err := a.Abort(); err != nil {
+					log.Printf("Couldn't abort %T: %s", s, err)
+				}
+			}
+		}
+	})
 }
 
 // Merge config with env, envs wins
 
 // TYPE_KEY=VALUE
 func mergeEnv(prefix string, conf map[string]string) map[string]string {
+	if conf == nil {
+		conf = make(map[string]string)
+	}
 	for _, env := range os.Environ() {
 		parts := strings.SplitN(env, "=", 2)
 		if len(parts) != 2 {
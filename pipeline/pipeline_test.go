@@ -1,9 +1,16 @@
 package pipeline
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // dummy buffer for testing
@@ -15,13 +22,29 @@ func (b *buffer) Close() (err error) {
 	return
 }
 
+// failing output for testing
+type brokenOutput struct {
+	aborted bool
+}
+
+func (o *brokenOutput) Write(p []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func (o *brokenOutput) Close() error { return nil }
+
+func (o *brokenOutput) Abort() error {
+	o.aborted = true
+	return nil
+}
+
 func TestPipeline(t *testing.T) {
 	in := bytes.NewBuffer([]byte("Hello World"))
 	out := &buffer{} //bytes.Buffer{}
 
 	p := &Pipeline{
-		input:  in,
-		output: out,
+		input:   in,
+		outputs: []namedOutput{{name: "buffer", output: out}},
 	}
 	if _, err := p.Run(); err != nil {
 		t.Fatal(err)
@@ -31,6 +54,78 @@ func TestPipeline(t *testing.T) {
 	}
 }
 
+func TestPipelineFanout(t *testing.T) {
+	in := bytes.NewBuffer([]byte("Hello World"))
+	out1 := &buffer{}
+	out2 := &buffer{}
+
+	p := &Pipeline{
+		input:   in,
+		outputs: []namedOutput{{name: "out1", output: out1}, {name: "out2", output: out2}},
+		policy:  OutputPolicyAll,
+	}
+	result, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []*buffer{out1, out2} {
+		if out.String() != "Hello World" {
+			t.Fatal("Unexpected: ", out.String())
+		}
+	}
+	for _, o := range result.Outputs {
+		if o.Bytes != 11 {
+			t.Fatalf("Unexpected byte count for %s: %d", o.Name, o.Bytes)
+		}
+	}
+}
+
+func TestPipelineFanoutPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for policy, fail := range map[string]bool{
+		OutputPolicyAll: true,
+		OutputPolicyAny: false,
+	} {
+		path := filepath.Join(dir, policy)
+		out, err := newFileOutput(map[string]string{"path": path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		broken := &brokenOutput{}
+		p := &Pipeline{
+			input:   bytes.NewBuffer([]byte("Hello World")),
+			outputs: []namedOutput{{name: "broken", output: broken}, {name: "file", output: out}},
+			policy:  policy,
+		}
+		result, err := p.Run()
+		if (err != nil) != fail {
+			t.Fatalf("Unexpected error for policy %s: %v", policy, err)
+		}
+		if result.Outputs[0].Err == nil {
+			t.Fatalf("Expected broken output to fail for policy %s", policy)
+		}
+		if !broken.aborted {
+			t.Fatalf("Expected broken output to be aborted for policy %s", policy)
+		}
+		// Aborted files are removed instead of left truncated
+		data, err := ioutil.ReadFile(path)
+		if fail && !os.IsNotExist(err) {
+			t.Fatalf("Expected no file for policy %s: %v", policy, err)
+		}
+		if !fail && string(data) != "Hello World" {
+			t.Fatalf("Unexpected %q: %v", data, err)
+		}
+		if names, _ := filepath.Glob(filepath.Join(dir, "*"+partialSuffix)); len(names) > 0 {
+			t.Fatalf("Unexpected partial files %v for policy %s", names, policy)
+		}
+	}
+}
+
 func TestEnvMerge(t *testing.T) {
 	conf := map[string]string{
 		"foo": "bar",
@@ -42,3 +137,106 @@ func TestEnvMerge(t *testing.T) {
 		t.Fatal("Unexpected conf: ", conf)
 	}
 }
+
+func TestPipelineStageFailure(t *testing.T) {
+	in, err := newCommandInput(map[string]string{"command": "sh -c 'echo Hello World; exit 1'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &buffer{}
+	p := &Pipeline{
+		input:   in,
+		outputs: []namedOutput{{name: "buffer", output: out}},
+	}
+	if _, err := p.Run(); err == nil {
+		t.Fatal("Expected failing command to fail the pipeline")
+	}
+}
+
+func TestPipelineFilterFailure(t *testing.T) {
+	// The filter fails while the input still writes
+	in, err := newCommandInput(map[string]string{"command": "yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newGUnzipFilter(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pipeline{
+		input:   in,
+		filters: []filter{f},
+		outputs: []namedOutput{{name: "buffer", output: &buffer{}}},
+	}
+	_, err = p.Run()
+	if err == nil || !strings.Contains(err.Error(), "gzip") {
+		t.Fatalf("Expected error of filter, got %v", err)
+	}
+	if in.(*commandInput).command.ProcessState == nil {
+		t.Fatal("Expected input to be waited for")
+	}
+}
+
+func TestPipelineOutputFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Untar fails while data is still written, or only when closed
+	for _, padding := range []int{4 * 1024 * 1024, 0} {
+		archive := testArchive(t, &tar.Header{Name: "../escaped", Typeflag: tar.TypeReg})
+		archive.Write(make([]byte, padding))
+		out, err := newUntarOutput(map[string]string{"path": dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Pipeline{
+			input:   archive,
+			outputs: []namedOutput{{name: "untar", output: out}},
+		}
+		_, err = p.Run()
+		if err == nil || !strings.Contains(err.Error(), "Output untar failed") || !strings.Contains(err.Error(), "Unsafe path ../escaped in archive") {
+			t.Fatalf("Expected error of output, got %v", err)
+		}
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	for _, tc := range []struct {
+		input, filter string
+	}{
+		{"sleep 10", ""},
+		// Grandchildren keep the pipes open unless killed too
+		{"sh -c 'sleep 3; echo x'", ""},
+		{"sh -c 'sleep 3 | cat'", ""},
+		{"echo x", "sh -c 'sleep 3 | cat'"},
+	} {
+		in, err := newCommandInput(map[string]string{"command": tc.input})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Pipeline{
+			input:   in,
+			outputs: []namedOutput{{name: "buffer", output: &buffer{}}},
+		}
+		if tc.filter != "" {
+			f, err := newCommandFilter(map[string]string{"command": tc.filter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.filters = []filter{f}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+
+		begin := time.Now()
+		if _, err := p.RunContext(ctx); err == nil {
+			t.Fatalf("Expected canceled pipeline %s | %s to fail", tc.input, tc.filter)
+		}
+		cancel()
+		if d := time.Since(begin); d > time.Second {
+			t.Fatalf("Pipeline %s | %s wasn't canceled, took %s", tc.input, tc.filter, d)
+		}
+	}
+}
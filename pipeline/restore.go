@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// inverseFunc returns the config of the stage reversing a stage with the
+// given config.
+type inverseFunc func(conf map[string]string) (commonConfig, error)
+
+var (
+	inputInverseMap  = make(map[string]inverseFunc) // input -> output
+	filterInverseMap = make(map[string]inverseFunc) // filter -> filter
+	outputInverseMap = make(map[string]inverseFunc) // output -> input
+)
+
+// inverseAs returns an inverseFunc for a stage of given type, copying the
+// given config keys.
+func inverseAs(typ string, keys ...string) inverseFunc {
+	return func(conf map[string]string) (commonConfig, error) {
+		c := commonConfig{Type: typ, Config: make(map[string]string)}
+		for _, key := range keys {
+			if v, ok := conf[key]; ok {
+				c.Config[key] = v
+			}
+		}
+		return c, nil
+	}
+}
+
+// NewRestore returns a pipeline restoring the backup made by the given
+// pipeline config. It reads from the output with the given name, or the
+// first one if name is empty. Config the inverse stages need but the
+// backup config doesn't have, like the private key for unpgp, is taken
+// from the environment like for any other pipeline.
+func NewRestore(configFile, name string) (*Pipeline, error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	inverse, err := conf.inverse(name)
+	if err != nil {
+		return nil, err
+	}
+	return newFromConfig(inverse)
+}
+
+// NewRestoreManifest returns a pipeline restoring the backup described by
+// the manifest, made by the given pipeline config.
+func NewRestoreManifest(configFile string, m *Manifest) (*Pipeline, error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if conf.hash != m.ConfigHash {
+		log.Printf("Config %s changed since the backup was made", configFile)
+	}
+	inverse, err := conf.inverse(m.Output)
+	if err != nil {
+		return nil, err
+	}
+	if m.LocationKey != "" {
+		inverse.Input.Config[m.LocationKey] = m.Location
+	}
+	return newFromConfig(inverse)
+}
+
+// RestoreChain returns the manifests of the backups to restore in order,
+// to restore the backup described by the given manifest: The full backup
+// it's based on, followed by the differential and incremental ones.
+func RestoreChain(configFile string, m *Manifest) ([]*Manifest, error) {
+	chain := []*Manifest{m}
+	if m.Level == 0 {
+		return chain, nil
+	}
+	catalog, _, err := ReadCatalogConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if catalog == "" {
+		return nil, fmt.Errorf("Restoring a level %d backup needs the catalog", m.Level)
+	}
+	manifests, err := ReadCatalog(catalog, m.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(manifests) - 1; i >= 0 && chain[0].Level > 0; i-- {
+		b := manifests[i]
+		if b.Output == m.Output && b.Level < chain[0].Level && b.Start.Before(chain[0].Start) {
+			chain = append([]*Manifest{b}, chain...)
+		}
+	}
+	if chain[0].Level > 0 {
+		return nil, fmt.Errorf("No backup with level below %d found before %s", chain[0].Level, chain[0].Start)
+	}
+	return chain, nil
+}
+
+func (c *config) inverse(name string) (*config, error) {
+	outputs := c.Outputs
+	if c.Output.Type != "" {
+		outputs = append([]outputConfig{c.Output}, outputs...)
+	}
+	var from *outputConfig
+	for i, o := range outputs {
+		if name == "" || o.Name == name || (o.Name == "" && o.Type == name) {
+			from = &outputs[i]
+			break
+		}
+	}
+	if from == nil {
+		return nil, fmt.Errorf("No output %s to restore from", name)
+	}
+
+	ic, err := invert(outputInverseMap, "output", from.commonConfig)
+	if err != nil {
+		return nil, err
+	}
+	oc, err := invert(inputInverseMap, "input", c.Input)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := c.Filters.list()
+	if err != nil {
+		return nil, err
+	}
+	inverseFilters := []commonConfig{}
+	for i := len(filters) - 1; i >= 0; i-- {
+		fc, err := invert(filterInverseMap, "filter", filters[i])
+		if err != nil {
+			return nil, err
+		}
+		inverseFilters = append(inverseFilters, fc)
+	}
+	fc, err := chainFilters(inverseFilters)
+	if err != nil {
+		return nil, err
+	}
+	return &config{
+		Name:    c.Name,
+		Input:   ic,
+		Filters: fc,
+		Output:  outputConfig{commonConfig: oc},
+	}, nil
+}
+
+func invert(m map[string]inverseFunc, kind string, c commonConfig) (commonConfig, error) {
+	inverseNew, ok := m[c.Type]
+	if !ok {
+		return commonConfig{}, fmt.Errorf("Can't restore, %s %s has no inverse", kind, c.Type)
+	}
+	return inverseNew(c.Config)
+}
+
+// chainFilters returns a filterConfig chaining the given filters in order.
+func chainFilters(filters []commonConfig) (filterConfig, error) {
+	fc := filterConfig{}
+	for i := len(filters) - 1; i >= 0; i-- {
+		next := fc
+		fc = filterConfig{commonConfig: filters[i]}
+		if next.Type == "" {
+			continue
+		}
+		data, err := json.Marshal(next)
+		if err != nil {
+			return fc, err
+		}
+		fc.Next = data
+	}
+	return fc, nil
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigInverse(t *testing.T) {
+	conf := &config{}
+	if err := json.Unmarshal([]byte(`{
+		"input": {"type": "tar", "config": {"path": "/data/db"}},
+		"filters": {"type": "gzip", "next": {"type": "pgp", "config": {"pubkey": "key"}}},
+		"outputs": [
+			{"name": "local", "type": "file", "config": {"path": "/backup/db.tar.gz.gpg"}},
+			{"name": "remote", "type": "s3", "config": {"bucket": "backups", "filename": "db.tar.gz.gpg"}}
+		]
+	}`), conf); err != nil {
+		t.Fatal(err)
+	}
+	inverse, err := conf.inverse("remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inverse.Input.Type != "s3" || inverse.Input.Config["bucket"] != "backups" || inverse.Input.Config["filename"] != "db.tar.gz.gpg" {
+		t.Fatalf("Unexpected input %#v", inverse.Input)
+	}
+	// The target must be given explicitly
+	if _, ok := inverse.Output.Config["path"]; inverse.Output.Type != "untar" || ok {
+		t.Fatalf("Unexpected output %#v", inverse.Output)
+	}
+	filters, err := inverse.Filters.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 || filters[0].Type != "unpgp" || filters[1].Type != "gunzip" {
+		t.Fatalf("Unexpected filters %#v", filters)
+	}
+	if _, ok := filters[0].Config["pubkey"]; ok {
+		t.Fatal("Config of pgp shouldn't be passed to unpgp")
+	}
+}
+
+func TestConfigInverseMissing(t *testing.T) {
+	conf := &config{
+		Input:  commonConfig{Type: "command", Config: map[string]string{"command": "pg_dump"}},
+		Output: outputConfig{commonConfig: commonConfig{Type: "file"}},
+	}
+	if _, err := conf.inverse(""); err == nil {
+		t.Fatal("Expected command input without inverse to fail")
+	}
+}
+
+func TestRestoreTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backup := filepath.Join(dir, "backup.tar")
+	if err := ioutil.WriteFile(backup, testArchive(t).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "backup.json")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`{
+		"input": {"type": "tar", "config": {"path": %q}},
+		"output": {"type": "file", "config": {"path": %q}}
+	}`, filepath.Join(dir, "data"), backup)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRestore(configFile, ""); err == nil {
+		t.Fatal("Expected restore without target to fail")
+	}
+	os.Setenv("OUTPUT_path", dir)
+	defer os.Unsetenv("OUTPUT_path")
+	p, err := NewRestore(configFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var templateAction = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// pruner is implemented by outputs storing backups which can be listed
+// and deleted to apply a retention policy.
+type pruner interface {
+	locator
+	// list returns all backups with the given prefix.
+	list(prefix string) ([]backup, error)
+	remove(name string) error
+}
+
+type backup struct {
+	Name  string
+	Time  time.Time
+	Level int // 0 for full backups, see leveler
+}
+
+// retention decides which backups to keep, grandfather-father-son style:
+// The last backups plus the latest backup of the last days, weeks and
+// months are kept.
+type retention struct {
+	last, daily, weekly, monthly int
+	dryRun                       bool
+
+	prefix  string         // Static part of the location
+	pattern *regexp.Regexp // Matches all locations of the pipeline
+}
+
+// newRetention returns the retention for an output with given raw (not
+// yet expanded) config, nil if no retention is configured. The vars of
+// the pipeline select its backups if they share a location.
+func newRetention(conf map[string]string, location string, vars *Vars) (*retention, error) {
+	r := &retention{}
+	for key, n := range map[string]*int{
+		"keep_last":    &r.last,
+		"keep_daily":   &r.daily,
+		"keep_weekly":  &r.weekly,
+		"keep_monthly": &r.monthly,
+	} {
+		if conf[key] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(conf[key])
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("Invalid %s %s", key, conf[key])
+		}
+		*n = v
+	}
+	if r.last+r.daily+r.weekly+r.monthly == 0 {
+		return nil, nil
+	}
+	r.dryRun = conf["prune_dry_run"] == "true"
+
+	if !templateAction.MatchString(location) {
+		return nil, errors.New("Retention requires a templated location")
+	}
+	var err error
+	if r.prefix, r.pattern, err = locationPattern(location, vars); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// locationPattern returns the static prefix of a templated location and
+// a regexp matching all locations it expands to for the pipeline. Actions
+// expanding to the same value for every run, like {{.Name}}, must match
+// literally. Others are expanded with sample values, whose digits and
+// letters then match any number of digits and letters, so the backups of
+// other pipelines and files in other directories don't match.
+func locationPattern(location string, vars *Vars) (string, *regexp.Regexp, error) {
+	samples := []*Vars{
+		{Time: time.Date(2006, 1, 2, 15, 4, 5, 123456789, time.Local)},
+		{Time: time.Date(2017, 11, 28, 22, 59, 58, 987654321, time.Local)},
+	}
+	for _, sample := range samples {
+		sample.Name = vars.Name
+		sample.Hostname = vars.Hostname
+	}
+	prefix := ""
+	pattern := &bytes.Buffer{}
+	pattern.WriteString("^")
+	static := true
+	rest := location
+	for _, i := range templateAction.FindAllStringIndex(location, -1) {
+		literal := location[len(location)-len(rest) : i[0]]
+		action := location[i[0]:i[1]]
+		rest = location[i[1]:]
+		if static {
+			prefix += literal
+		}
+		pattern.WriteString(regexp.QuoteMeta(literal))
+
+		expanded := make([]string, len(samples))
+		for j, sample := range samples {
+			var err error
+			if expanded[j], err = sample.expandValue("location", action); err != nil {
+				return "", nil, err
+			}
+		}
+		if expanded[0] == expanded[1] {
+			if static {
+				prefix += expanded[0]
+			}
+			pattern.WriteString(regexp.QuoteMeta(expanded[0]))
+			continue
+		}
+		static = false
+		pattern.WriteString(generalize(expanded[0]))
+	}
+	if static {
+		prefix += rest
+	}
+	pattern.WriteString(regexp.QuoteMeta(rest) + "$")
+	re, err := regexp.Compile(pattern.String())
+	return prefix, re, err
+}
+
+// generalize returns a regexp matching s with runs of digits and letters
+// replaced by any number of digits and letters.
+func generalize(s string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); {
+		switch class := charClass(s[i]); class {
+		case "":
+			buf.WriteString(regexp.QuoteMeta(s[i : i+1]))
+			i++
+		default:
+			for i < len(s) && charClass(s[i]) == class {
+				i++
+			}
+			buf.WriteString(class + "+")
+		}
+	}
+	return buf.String()
+}
+
+func charClass(c byte) string {
+	switch {
+	case c >= '0' && c <= '9':
+		return "[0-9]"
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return "[A-Za-z]"
+	}
+	return ""
+}
+
+// expired returns the backups not to keep.
+func (r *retention) expired(backups []backup) []backup {
+	sort.Sort(byTime(backups))
+	keep := make(map[int]bool)
+	for i := 0; i < r.last && i < len(backups); i++ {
+		keep[i] = true
+	}
+	keepPeriods(backups, keep, r.daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(backups, keep, r.weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepPeriods(backups, keep, r.monthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	keepChains(backups, keep)
+
+	expired := []backup{}
+	for i, b := range backups {
+		if !keep[i] {
+			expired = append(expired, b)
+		}
+	}
+	return expired
+}
+
+// keepPeriods marks the latest backup of the last n periods to keep.
+func keepPeriods(backups []backup, keep map[int]bool, n int, period func(time.Time) string) {
+	last := ""
+	for i := 0; i < len(backups) && n > 0; i++ {
+		p := period(backups[i].Time)
+		if p == last {
+			continue
+		}
+		last = p
+		keep[i] = true
+		n--
+	}
+}
+
+// keepChains marks the backups needed to restore the kept ones: the
+// latest previous backup of each lower level, like RestoreChain.
+func keepChains(backups []backup, keep map[int]bool) {
+	for i := range backups {
+		if !keep[i] {
+			continue
+		}
+		level := backups[i].Level
+		for j := i + 1; j < len(backups) && level > 0; j++ {
+			if backups[j].Level < level {
+				keep[j] = true
+				level = backups[j].Level
+			}
+		}
+	}
+}
+
+// prune deletes the expired backups of the output, except for current,
+// and returns their names. The levels of backups missing in levels
+// default to 0.
+func (r *retention) prune(p pruner, current string, levels map[string]int) ([]string, error) {
+	all, err := p.list(r.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't list backups: %s", err)
+	}
+	backups := []backup{}
+	sidecars := make(map[string][]string)
+	for _, b := range all {
+		if name, ok := sidecarOf(b.Name); ok {
+			sidecars[name] = append(sidecars[name], b.Name)
+			continue
+		}
+		if b.Name != current && r.pattern.MatchString(b.Name) {
+			b.Level = levels[b.Name]
+			backups = append(backups, b)
+		}
+	}
+	// The current backup isn't necessarily listed yet, but counts
+	backups = append(backups, backup{Name: current, Time: time.Now(), Level: levels[current]})
+
+	pruned := []string{}
+	for _, b := range r.expired(backups) {
+		if b.Name == current {
+			continue
+		}
+		if r.dryRun {
+			log.Printf("Would prune %s from %s", b.Name, b.Time)
+			continue
+		}
+		log.Printf("Pruning %s from %s", b.Name, b.Time)
+		for _, name := range append(sidecars[b.Name], b.Name) {
+			if err := p.remove(name); err != nil {
+				return pruned, fmt.Errorf("Couldn't prune %s: %s", name, err)
+			}
+		}
+		pruned = append(pruned, b.Name)
+	}
+	return pruned, nil
+}
+
+// sidecarOf returns the name of the backup if name is a checksum sidecar.
+func sidecarOf(name string) (string, bool) {
+	for algorithm := range checksumAlgorithms {
+		if strings.HasSuffix(name, "."+algorithm) {
+			return strings.TrimSuffix(name, "."+algorithm), true
+		}
+	}
+	return "", false
+}
+
+// byTime sorts backups, latest first.
+type byTime []backup
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTime) Less(i, j int) bool { return b[i].Time.After(b[j].Time) }
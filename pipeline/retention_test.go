@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	r, err := newRetention(map[string]string{
+		"keep_last":    "2",
+		"keep_daily":   "3",
+		"keep_monthly": "2",
+	}, "db-{{.Time}}", &Vars{Name: "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	backups := []backup{}
+	for i := 0; i < 24*60; i += 6 { // Every 6 hours for 60 days
+		backups = append(backups, backup{
+			Name: begin.Add(-time.Duration(i) * time.Hour).Format(time.RFC3339),
+			Time: begin.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	expired := make(map[string]bool)
+	for _, b := range r.expired(backups) {
+		expired[b.Name] = true
+	}
+	for _, name := range []string{
+		"2026-10-18T12:00:00Z", // last & daily & monthly
+		"2026-10-18T06:00:00Z", // last
+		"2026-10-17T18:00:00Z", // daily
+		"2026-10-16T18:00:00Z", // daily
+		"2026-09-30T18:00:00Z", // monthly
+	} {
+		if expired[name] {
+			t.Fatalf("Expected %s to be kept", name)
+		}
+	}
+	if kept := len(backups) - len(expired); kept != 5 {
+		t.Fatalf("Expected to keep 5 backups, kept %d", kept)
+	}
+}
+
+func TestRetentionChains(t *testing.T) {
+	r, err := newRetention(map[string]string{"keep_last": "2"}, "db-{{.Time.Unix}}", &Vars{Name: "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	backups := []backup{}
+	// Oldest first: full, differential, incremental, full, incremental...
+	for i, level := range []int{0, 1, 2, 0, 1, 2, 1, 2, 3} {
+		backups = append(backups, backup{
+			Name:  strconv.Itoa(i),
+			Time:  begin.Add(time.Duration(i) * time.Hour),
+			Level: level,
+		})
+	}
+	expired := []string{}
+	for _, b := range r.expired(backups) {
+		expired = append(expired, b.Name)
+	}
+	sort.Strings(expired)
+	// 8 and 7 are kept, which need 6 and 3
+	if expected := []string{"0", "1", "2", "4", "5"}; !reflect.DeepEqual(expired, expected) {
+		t.Fatalf("Unexpected expired backups %v, expected %v", expired, expected)
+	}
+}
+
+func TestRetentionPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"db-1", "db-1.sha256", "db-2", "db-3", "other"}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-time.Duration(len(names)-i) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := filepath.Join(dir, "db-4")
+	output, err := newFileOutput(map[string]string{"path": current})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pruning follows closing the output
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []string{"true", "false"} {
+		r, err := newRetention(map[string]string{"keep_last": "2", "prune_dry_run": dryRun}, filepath.Join(dir, "db-{{.Time.Unix}}"), &Vars{Name: "db"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.prune(output.(pruner), current, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, exists := range map[string]bool{
+		"db-1":        false,
+		"db-1.sha256": false,
+		"db-2":        false,
+		"db-3":        true,
+		"db-4":        true,
+		"other":       true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == exists {
+			t.Fatalf("Unexpected existence of %s: %v", name, err)
+		}
+	}
+}
+
+func TestRetentionSharedLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, `{{.Name}}/{{strftime "%Y/%m/%d" .Time}}/{{.Name}}-{{.Time.Unix}}.tar`)
+	for _, name := range []string{
+		"db/2026/10/16/db-1.tar",
+		"db/2026/10/17/db-2.tar",
+		"db/2026/10/17/db-2.tar.sha256",
+		"db/2026/10/17/db-old-3.tar",
+		"db/2026/10/17/db-4.tar.json",
+		"db/2026/10/17/sub/db-5.tar",
+		"db-old/2026/10/17/db-old-1.tar",
+		"web/2026/10/17/web-1.tar",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := filepath.Join(dir, "db/2026/10/18/db-6.tar")
+	if err := os.MkdirAll(filepath.Dir(current), 0755); err != nil {
+		t.Fatal(err)
+	}
+	output, err := newFileOutput(map[string]string{"path": current})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pruning follows closing the output
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newRetention(map[string]string{"keep_last": "1"}, location, &Vars{Name: "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(dir, "db") + "/"; r.prefix != expected {
+		t.Fatalf("Unexpected prefix %s, expected %s", r.prefix, expected)
+	}
+	if _, err := r.prune(output.(pruner), current, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{
+		"db/2026/10/16/db-1.tar":         false,
+		"db/2026/10/17/db-2.tar":         false,
+		"db/2026/10/17/db-2.tar.sha256":  false,
+		"db/2026/10/17/db-old-3.tar":     true,
+		"db/2026/10/17/db-4.tar.json":    true,
+		"db/2026/10/17/sub/db-5.tar":     true,
+		"db-old/2026/10/17/db-old-1.tar": true,
+		"web/2026/10/17/web-1.tar":       true,
+		"db/2026/10/18/db-6.tar":         true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == exists {
+			t.Errorf("Unexpected existence of %s: %v", name, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import "io"
 
 func init() {
 	filterMap["rot13"] = newRot13Filter
+	filterInverseMap["rot13"] = inverseAs("rot13")
 }
 
 type rot13Filter struct {
@@ -2,12 +2,21 @@ package pipeline
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 
 	"github.com/rlmcpherson/s3gof3r"
 )
 
 func init() {
 	inputMap["s3"] = newS3Input
+	inputInverseMap["s3"] = inverseAs("s3", "bucket", "filename", "endpoint")
+}
+
+type s3Input struct {
+	io.ReadCloser
+	bucket   *s3gof3r.Bucket
+	fileName string
 }
 
 func newS3Input(conf map[string]string) (input, error) {
@@ -20,13 +29,26 @@ func newS3Input(conf map[string]string) (input, error) {
 		return nil, errors.New("No file name specified")
 	}
 
-	keys, err := s3gof3r.EnvKeys()
+	bucket, err := newS3Bucket(bucketName, conf["endpoint"])
 	if err != nil {
 		return nil, err
 	}
-	s3 := s3gof3r.New(conf["endpoint"], keys)
-	bucket := s3.Bucket(bucketName)
-
 	r, _, err := bucket.GetReader(fileName, nil)
-	return r, err
+	if err != nil {
+		return nil, err
+	}
+	return &s3Input{
+		ReadCloser: r,
+		bucket:     bucket,
+		fileName:   fileName,
+	}, nil
+}
+
+func (i *s3Input) readSidecar(suffix string) ([]byte, error) {
+	r, _, err := i.bucket.GetReader(i.fileName+suffix, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
@@ -1,13 +1,27 @@
 package pipeline
 
 import (
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/rlmcpherson/s3gof3r"
 )
 
 func init() {
 	outputMap["s3"] = newS3Output
+	outputInverseMap["s3"] = inverseAs("s3", "bucket", "filename", "endpoint")
+}
+
+type s3Output struct {
+	io.WriteCloser
+	bucket   *s3gof3r.Bucket
+	fileName string
 }
 
 func newS3Output(conf map[string]string) (output, error) {
@@ -20,12 +34,156 @@ func newS3Output(conf map[string]string) (output, error) {
 		return nil, errors.New("No file name specified")
 	}
 
+	bucket, err := newS3Bucket(bucketName, conf["endpoint"])
+	if err != nil {
+		return nil, err
+	}
+	w, err := bucket.PutWriter(fileName, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Output{
+		WriteCloser: w,
+		bucket:      bucket,
+		fileName:    fileName,
+	}, nil
+}
+
+// newS3Bucket returns the bucket at the given endpoint, which may be
+// given as URL like http://localhost:9000 to set the scheme.
+func newS3Bucket(name, endpoint string) (*s3gof3r.Bucket, error) {
 	keys, err := s3gof3r.EnvKeys()
 	if err != nil {
 		return nil, err
 	}
-	s3 := s3gof3r.New(conf["endpoint"], keys)
-	bucket := s3.Bucket(bucketName)
+	config := *s3gof3r.DefaultConfig
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
+		}
+		config.Scheme = u.Scheme
+		endpoint = u.Host
+	}
+	bucket := s3gof3r.New(endpoint, keys).Bucket(name)
+	bucket.Config = &config
+	return bucket, nil
+}
+
+type listMultipartUploadsResult struct {
+	IsTruncated bool
+	Upload      []struct {
+		Key      string
+		UploadId string
+	}
+}
+
+// Abort aborts the multipart upload. s3gof3r only aborts uploads on
+// errors internally and keeps the upload id to itself, so we list the
+// uploads of the file and abort them.
+func (o *s3Output) Abort() error {
+	key := strings.TrimPrefix(o.fileName, "/")
+	resp, err := o.do("GET", "", url.Values{"uploads": {""}, "prefix": {key}})
+	if err != nil {
+		return err
+	}
+	result := &listMultipartUploadsResult{}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Couldn't list uploads: %s", resp.Status)
+	} else {
+		err = xml.NewDecoder(resp.Body).Decode(result)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, upload := range result.Upload {
+		if upload.Key != key {
+			continue
+		}
+		resp, err := o.do("DELETE", key, url.Values{"uploadId": {upload.UploadId}})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("Couldn't abort upload: %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// do sends a signed request for the given path in the bucket.
+func (o *s3Output) do(method, path string, query url.Values) (*http.Response, error) {
+	u := &url.URL{
+		Scheme:   o.bucket.Scheme,
+		Host:     o.bucket.Name + "." + o.bucket.Domain,
+		Path:     "/" + strings.TrimPrefix(path, "/"),
+		RawQuery: query.Encode(),
+	}
+	if strings.Contains(o.bucket.Name, ".") || o.bucket.PathStyle { // Same as s3gof3r's addressing
+		u.Host = o.bucket.Domain
+		u.Path = "/" + o.bucket.Name + u.Path
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	o.bucket.Sign(req)
+	return o.bucket.Client.Do(req)
+}
 
-	return bucket.PutWriter(fileName, nil, nil)
+func (o *s3Output) locationKey() string { return "filename" }
+
+type listBucketResult struct {
+	IsTruncated bool
+	Contents    []struct {
+		Key          string
+		LastModified time.Time
+	}
+}
+
+// list lists the objects with given prefix, which s3gof3r doesn't support.
+func (o *s3Output) list(prefix string) ([]backup, error) {
+	backups := []backup{}
+	query := url.Values{"prefix": {strings.TrimPrefix(prefix, "/")}}
+	for {
+		resp, err := o.do("GET", "", query)
+		if err != nil {
+			return nil, err
+		}
+		result := &listBucketResult{}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Couldn't list bucket: %s", resp.Status)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			backups = append(backups, backup{Name: c.Key, Time: c.LastModified})
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return backups, nil
+		}
+		query.Set("marker", result.Contents[len(result.Contents)-1].Key)
+	}
+}
+
+func (o *s3Output) remove(name string) error {
+	return o.bucket.Delete(name)
+}
+
+func (o *s3Output) writeSidecar(suffix string, data []byte) error {
+	w, err := o.bucket.PutWriter(o.fileName+suffix, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
 }
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestS3OutputAbort(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		aborted []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/my.bucket/backup.tar":
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>mine</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "GET" && r.URL.Path == "/my.bucket/" && query.Get("prefix") == "backup.tar":
+			fmt.Fprint(w, `<ListMultipartUploadsResult>
+				<Upload><Key>backup.tar</Key><UploadId>mine</UploadId></Upload>
+				<Upload><Key>backup.tar.old</Key><UploadId>other</UploadId></Upload>
+			</ListMultipartUploadsResult>`)
+		case r.Method == "DELETE" && r.URL.Path == "/my.bucket/backup.tar":
+			mu.Lock()
+			aborted = append(aborted, query.Get("uploadId"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "key",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_REGION":            "us-east-1",
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	// Bucket names with dots are addressed by path
+	o, err := newS3Output(map[string]string{"bucket": "my.bucket", "filename": "backup.tar", "endpoint": ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.(aborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(aborted, ",") != "mine" {
+		t.Fatalf("Unexpected aborted uploads %v", aborted)
+	}
+}
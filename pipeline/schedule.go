@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Schedule defines when a pipeline runs in daemon mode.
+type Schedule struct {
+	cron.Schedule
+	Jitter time.Duration
+}
+
+// ReadSchedule returns the schedule of the given pipeline config or nil
+// if it has none. The schedule is either a standard cron expression,
+// a descriptor like @daily or @every 1h, or a plain interval like 1h.
+func ReadSchedule(configFile string) (*Schedule, error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Schedule == "" {
+		return nil, nil
+	}
+	s := &Schedule{}
+	if interval, err := time.ParseDuration(conf.Schedule); err == nil {
+		s.Schedule = cron.Every(interval)
+	} else if s.Schedule, err = cron.ParseStandard(conf.Schedule); err != nil {
+		return nil, fmt.Errorf("Invalid schedule %s: %s", conf.Schedule, err)
+	}
+	if conf.Jitter != "" {
+		if s.Jitter, err = time.ParseDuration(conf.Jitter); err != nil {
+			return nil, fmt.Errorf("Invalid jitter %s: %s", conf.Jitter, err)
+		}
+	}
+	return s, nil
+}
+
+// ReadLocks returns the names of the locks the given pipeline needs to
+// hold while running. Pipelines sharing a lock never run concurrently.
+func ReadLocks(configFile string) ([]string, error) {
+	conf, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Locks, nil
+}
+
+// RandomJitter returns a random delay between 0 and the jitter.
+func (s *Schedule) RandomJitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)))
+}
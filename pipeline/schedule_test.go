@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadSchedule(t *testing.T) {
+	begin := time.Date(2015, 1, 1, 0, 30, 0, 0, time.UTC)
+	for schedule, expected := range map[string]time.Time{
+		"1h":           begin.Add(time.Hour),
+		"@every 1h":    begin.Add(time.Hour),
+		"0 3 * * *":    time.Date(2015, 1, 1, 3, 0, 0, 0, time.UTC),
+		"15 * * * 1-5": time.Date(2015, 1, 1, 1, 15, 0, 0, time.UTC),
+	} {
+		file, err := ioutil.TempFile("", tempPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.WriteString(`{"schedule": "` + schedule + `", "jitter": "5m"}`); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		s, err := ReadSchedule(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := s.Next(begin); !next.Equal(expected) {
+			t.Fatalf("Unexpected next run for %s: %s != %s", schedule, next, expected)
+		}
+		if s.Jitter != 5*time.Minute {
+			t.Fatalf("Unexpected jitter %s", s.Jitter)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import "os"
 
 func init() {
 	inputMap["stdin"] = newStdinInput
+	inputInverseMap["stdin"] = inverseAs("stdout")
 }
 
 func newStdinInput(conf map[string]string) (input, error) {
@@ -4,6 +4,7 @@ import "os"
 
 func init() {
 	outputMap["stdout"] = newStdoutOutput
+	outputInverseMap["stdout"] = inverseAs("stdin")
 }
 
 func newStdoutOutput(conf map[string]string) (output, error) {
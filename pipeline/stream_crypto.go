@@ -0,0 +1,387 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted streams start with a header, followed by chunks of
+// chunkSize bytes of plaintext, each encrypted and authenticated with an
+// AEAD. The nonce of a chunk is its number and whether it's the last
+// chunk, so reordering, dropping or truncating chunks fails decryption
+// (STREAM construction). The header is authenticated as additional data
+// of all chunks.
+//
+// Header:
+//
+//	magic      [8]byte "BPCRYPT1"
+//	cipher     uint8
+//	chunkSize  uint32
+//	salt       [32]byte, to derive the key of the stream
+//	keySource  uint8
+//	params     uint16 length + bytes, needed by the key source
+const (
+	streamMagic          = "BPCRYPT1"
+	streamSaltSize       = 32
+	defaultChunkSize     = 64 * 1024
+	maxChunkSize         = 16 * 1024 * 1024
+	defaultScryptLogN    = 18
+	streamKeyInfo        = "byte-piper encrypt"
+	cipherAES256GCM      = 1
+	cipherXChaCha20      = 2
+	keySourceKeyFile     = 1
+	keySourcePassphrase  = 2
+	streamHeaderBaseSize = len(streamMagic) + 1 + 4 + streamSaltSize + 1 + 2
+)
+
+var (
+	streamCiphers = map[string]byte{
+		"aes-256-gcm":        cipherAES256GCM,
+		"xchacha20-poly1305": cipherXChaCha20,
+	}
+	errTruncated = errors.New("Encrypted data is truncated")
+
+	// keySourceConfig are the config keys of all key sources, passed on
+	// to the inverse filter.
+	keySourceConfig = []string{
+		"key_file", "passphrase", "passphrase_file", "passphrase_env", "work_factor",
+		"key_service", "vault_addr", "vault_token", "vault_token_file", "vault_token_env",
+		"vault_namespace", "vault_mount", "vault_key",
+	}
+)
+
+// keySource provides the keys of encrypted streams.
+type keySource interface {
+	id() byte
+	// newKey returns the key for a new stream and the params to store in
+	// its header.
+	newKey() (key, params []byte, err error)
+	// key returns the key of a stream with the given params.
+	key(params []byte) ([]byte, error)
+}
+
+// newKeySource returns the key source given in the config: key_file,
+// holding 32 bytes raw or hex encoded, passphrase or a key_service.
+func newKeySource(conf map[string]string) (keySource, error) {
+	switch conf["key_service"] {
+	case "":
+	case "vault":
+		return newVaultKey(conf)
+	default:
+		return nil, fmt.Errorf("Invalid key_service %s", conf["key_service"])
+	}
+	passphrase, err := readPassphrase(conf, "passphrase")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case conf["key_file"] != "" && passphrase != nil:
+		return nil, errors.New("Specify either key_file or passphrase")
+	case conf["key_file"] != "":
+		data, err := ioutil.ReadFile(conf["key_file"])
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read key_file: %s", err)
+		}
+		if key, err := hex.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+			data = key
+		}
+		if len(data) != 32 {
+			return nil, errors.New("key_file must contain 32 bytes, raw or hex encoded")
+		}
+		return fileKey(data), nil
+	case passphrase != nil:
+		logN := defaultScryptLogN
+		if conf["work_factor"] != "" {
+			n, err := strconv.Atoi(conf["work_factor"])
+			if err != nil || n < 10 || n > 30 {
+				return nil, fmt.Errorf("Invalid work_factor %s", conf["work_factor"])
+			}
+			logN = n
+		}
+		return &passphraseKey{passphrase: passphrase, logN: logN}, nil
+	}
+	return nil, errors.New("key_file, passphrase or key_service required")
+}
+
+type fileKey []byte
+
+func (k fileKey) id() byte                          { return keySourceKeyFile }
+func (k fileKey) newKey() ([]byte, []byte, error)   { return k, nil, nil }
+func (k fileKey) key(params []byte) ([]byte, error) { return k, nil }
+
+// passphraseKey derives keys from a passphrase with scrypt. The params
+// are the salt and log2 of the cost. Since the params aren't
+// authenticated before the key is derived, the cost is limited to logN.
+type passphraseKey struct {
+	passphrase []byte
+	logN       int
+}
+
+func (k *passphraseKey) id() byte { return keySourcePassphrase }
+
+func (k *passphraseKey) newKey() ([]byte, []byte, error) {
+	params := make([]byte, 17)
+	if _, err := io.ReadFull(rand.Reader, params[:16]); err != nil {
+		return nil, nil, err
+	}
+	params[16] = byte(k.logN)
+	key, err := k.key(params)
+	return key, params, err
+}
+
+func (k *passphraseKey) key(params []byte) ([]byte, error) {
+	if len(params) != 17 || params[16] < 10 {
+		return nil, errors.New("Invalid passphrase params")
+	}
+	if int(params[16]) > k.logN {
+		return nil, fmt.Errorf("Work factor %d of the data exceeds work_factor %d", params[16], k.logN)
+	}
+	return scrypt.Key(k.passphrase, params[:16], 1<<params[16], 8, 1, 32)
+}
+
+// streamHeader is the parsed header of an encrypted stream.
+type streamHeader struct {
+	cipher    byte
+	chunkSize int
+	salt      []byte
+	keySource byte
+	params    []byte
+}
+
+func (h *streamHeader) marshal() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(streamMagic)
+	buf.WriteByte(h.cipher)
+	binary.Write(buf, binary.BigEndian, uint32(h.chunkSize))
+	buf.Write(h.salt)
+	buf.WriteByte(h.keySource)
+	binary.Write(buf, binary.BigEndian, uint16(len(h.params)))
+	buf.Write(h.params)
+	return buf.Bytes()
+}
+
+// readStreamHeader reads the header and returns it, parsed and raw.
+func readStreamHeader(r io.Reader) (*streamHeader, []byte, error) {
+	raw := make([]byte, streamHeaderBaseSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't read header: %s", err)
+	}
+	if string(raw[:len(streamMagic)]) != streamMagic {
+		return nil, nil, errors.New("Not encrypted by the encrypt filter")
+	}
+	b := raw[len(streamMagic):]
+	h := &streamHeader{
+		cipher:    b[0],
+		chunkSize: int(binary.BigEndian.Uint32(b[1:5])),
+		salt:      b[5 : 5+streamSaltSize],
+		keySource: b[5+streamSaltSize],
+	}
+	if h.chunkSize < 1 || h.chunkSize > maxChunkSize {
+		return nil, nil, fmt.Errorf("Invalid chunk size %d", h.chunkSize)
+	}
+	h.params = make([]byte, binary.BigEndian.Uint16(b[6+streamSaltSize:]))
+	if _, err := io.ReadFull(r, h.params); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't read header: %s", err)
+	}
+	return h, append(raw, h.params...), nil
+}
+
+// newStreamAEAD returns the AEAD of a stream, keyed by a key derived from
+// the key and salt.
+func newStreamAEAD(cipherID byte, key, salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(streamKeyInfo)), streamKey); err != nil {
+		return nil, err
+	}
+	switch cipherID {
+	case cipherAES256GCM:
+		block, err := aes.NewCipher(streamKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherXChaCha20:
+		return chacha20poly1305.NewX(streamKey)
+	}
+	return nil, fmt.Errorf("Unknown cipher %d", cipherID)
+}
+
+// streamNonce returns the nonce of the given chunk.
+func streamNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// streamWriter encrypts chunks. Only full chunks are written before
+// Close, which writes the last chunk, even if it's empty.
+type streamWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	buf       []byte
+	counter   uint64
+}
+
+func newStreamWriter(w io.Writer, cipherID byte, chunkSize int, keys keySource) (*streamWriter, error) {
+	key, params, err := keys.newKey()
+	if err != nil {
+		return nil, err
+	}
+	h := &streamHeader{
+		cipher:    cipherID,
+		chunkSize: chunkSize,
+		salt:      make([]byte, streamSaltSize),
+		keySource: keys.id(),
+		params:    params,
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(cipherID, key, h.salt)
+	if err != nil {
+		return nil, err
+	}
+	sw := &streamWriter{
+		w:         w,
+		aead:      aead,
+		header:    h.marshal(),
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+	_, err = w.Write(sw.header)
+	return sw, err
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == s.chunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := s.chunkSize - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *streamWriter) flush(last bool) error {
+	chunk := s.aead.Seal(s.buf[:0], streamNonce(s.aead, s.counter, last), s.buf, s.header)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(chunk)
+	return err
+}
+
+func (s *streamWriter) Close() error {
+	return s.flush(true)
+}
+
+// streamReader decrypts chunks. A chunk is the last one if no data
+// follows it. If the data was truncated, the last chunk read wasn't
+// encrypted as last chunk, so decryption fails.
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+// newStreamReader reads the header and returns a reader for the
+// plaintext. The key source must be the one used for encryption.
+func newStreamReader(r io.Reader, keys keySource) (*streamReader, error) {
+	h, raw, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.keySource != keys.id() {
+		return nil, fmt.Errorf("Data was encrypted with key source %d, but %d given", h.keySource, keys.id())
+	}
+	key, err := keys.key(h.params)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(h.cipher, key, h.salt)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: raw,
+		buf:    make([]byte, h.chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	last := false
+	switch err {
+	case nil:
+		if _, err := s.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return errTruncated
+	default:
+		return err
+	}
+	if n < s.aead.Overhead() {
+		return errTruncated
+	}
+	plain, err := s.aead.Open(s.buf[:0], streamNonce(s.aead, s.counter, last), s.buf[:n], s.header)
+	if err != nil {
+		return fmt.Errorf("Couldn't decrypt chunk %d, data was truncated or tampered with", s.counter)
+	}
+	s.counter++
+	s.done = last
+	s.plain = plain
+	return nil
+}
@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"strings"
+)
+
+func init() {
+	filterMap["tarfilter"] = newTarFilter
+}
+
+// tarFilter rewrites a tar stream, keeping only the selected entries and
+// optionally replacing a prefix of their names. Since entries are dropped,
+// it has no inverse.
+type tarFilter struct {
+	selector    *entrySelector
+	stripPrefix string
+	addPrefix   string
+	r           *io.PipeReader
+}
+
+func newTarFilter(conf map[string]string) (filter, error) {
+	selector, err := newEntrySelector(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &tarFilter{
+		selector:    selector,
+		stripPrefix: strings.Trim(conf["strip_prefix"], "/"),
+		addPrefix:   strings.Trim(conf["add_prefix"], "/"),
+	}, nil
+}
+
+func (f *tarFilter) Link(r io.Reader) error {
+	pr, pw := io.Pipe()
+	f.r = pr
+	go func() {
+		err := f.filter(tar.NewReader(r), tar.NewWriter(pw))
+		if err != nil {
+			log.Print(err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return nil
+}
+
+func (f *tarFilter) Read(p []byte) (n int, err error) {
+	return f.r.Read(p)
+}
+
+// Abort closes the pipe, which stops the filtering.
+func (f *tarFilter) Abort() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.CloseWithError(errAborted)
+}
+
+func (f *tarFilter) filter(tr *tar.Reader, tw *tar.Writer) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		selected, err := f.selector.selected(hdr)
+		if err != nil {
+			return err
+		}
+		if !selected {
+			continue
+		}
+		if hdr.Name = f.rename(hdr.Name); hdr.Name == "" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = f.rename(hdr.Linkname)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// rename replaces strip_prefix by add_prefix. Names without the prefix
+// are kept, the prefix directory itself is dropped by returning empty.
+func (f *tarFilter) rename(name string) string {
+	isDir := strings.HasSuffix(name, "/")
+	name = entryName(name)
+	if f.stripPrefix != "" {
+		if name == f.stripPrefix {
+			return ""
+		}
+		name = strings.TrimPrefix(name, f.stripPrefix+"/")
+	}
+	if f.addPrefix != "" {
+		name = f.addPrefix + "/" + name
+	}
+	if isDir {
+		name += "/"
+	}
+	return name
+}
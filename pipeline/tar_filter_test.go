@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTarFilter(t *testing.T) {
+	archive := testArchive(t,
+		&tar.Header{Name: "data/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "data/b.log", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "data/sub/c.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "data/d.txt", Typeflag: tar.TypeLink, Linkname: "data/a.txt"},
+		&tar.Header{Name: "data/.wh.old.txt", Typeflag: tar.TypeReg, PAXRecords: map[string]string{whiteoutRecord: "1"}},
+		&tar.Header{Name: "data/.wh.old.log", Typeflag: tar.TypeReg, PAXRecords: map[string]string{whiteoutRecord: "1"}},
+	)
+	conf := map[string]string{
+		"exclude":      "*.log",
+		"strip_prefix": "data",
+		"add_prefix":   "restored/",
+	}
+	f, err := newTarFilter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Link(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[h.Name] = string(data) + h.Linkname
+	}
+	expected := map[string]string{
+		"restored/a.txt":       "data/a.txt",
+		"restored/sub/c.txt":   "data/sub/c.txt",
+		"restored/d.txt":       "restored/a.txt",
+		"restored/.wh.old.txt": "data/.wh.old.txt",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Unexpected entries %v, expected %v", entries, expected)
+	}
+
+	// Hardlinks to excluded entries fail instead of losing their data
+	f, err = newTarFilter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Link(testArchive(t,
+		&tar.Header{Name: "data/b.log", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "data/link.txt", Typeflag: tar.TypeLink, Linkname: "data/b.log"},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); err == nil || !strings.Contains(err.Error(), "data/link.txt") {
+		t.Fatalf("Expected hardlink to excluded entry to fail, got %v", err)
+	}
+}
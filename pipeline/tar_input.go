@@ -4,20 +4,39 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type tarInput struct {
 	path      string
-	r         io.Reader
+	r         *io.PipeReader
 	tarWriter *tar.Writer
+	selector  *fileSelector
+	w         io.Writer         // Written by tarWriter
+	links     map[fileID]string // First name of files with hardlinks
+
+	snapshotFile string
+	level        int
+	base         *snapshot // Files unchanged since are skipped, nil for full
+	current      *snapshot
+}
+
+// fileID identifies a file by device and inode, to detect hardlinks.
+type fileID struct {
+	dev, ino uint64
 }
 
 func init() {
 	inputMap["tar"] = newTarInput
+	// Without path, so restores never overwrite the archived data unless
+	// told to
+	inputInverseMap["tar"] = inverseAs("untar")
 }
 
 func newTarInput(conf map[string]string) (input, error) {
@@ -25,6 +44,10 @@ func newTarInput(conf map[string]string) (input, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, fmt.Errorf("%s does not exist", path)
 	}
+	selector, err := newFileSelector(conf)
+	if err != nil {
+		return nil, err
+	}
 
 	r, w := io.Pipe()
 	tarWriter := tar.NewWriter(w)
@@ -32,13 +55,26 @@ func newTarInput(conf map[string]string) (input, error) {
 		path:      path,
 		tarWriter: tarWriter,
 		r:         r,
+		selector:  selector,
+		w:         w,
+		links:     make(map[fileID]string),
 	}
-	go func(w io.WriteCloser) {
-		defer ti.tarWriter.Close() // This doesn *not* close the embedded writer
-		defer w.Close()            // So we do it here
-		if err := filepath.Walk(path, ti.addFile); err != nil {
-			log.Printf("Couldn't walk %s: %s", path, err)
+	if err := ti.readSnapshot(conf["snapshot"], conf["level"]); err != nil {
+		return nil, err
+	}
+	go func(w *io.PipeWriter) {
+		err := filepath.WalkDir(path, ti.addFile)
+		if err != nil {
+			err = fmt.Errorf("Couldn't walk %s: %s", path, err)
+		} else if err = ti.addWhiteouts(); err != nil {
+			err = fmt.Errorf("Couldn't mark deleted files: %s", err)
+		} else {
+			err = ti.tarWriter.Close() // This does *not* close the embedded writer
 		}
+		if err != nil {
+			log.Print(err)
+		}
+		w.CloseWithError(err) // So we do it here, passing on errors to the reader
 	}(w)
 	return ti, nil
 }
@@ -47,14 +83,141 @@ func (i *tarInput) Read(p []byte) (n int, err error) {
 	return i.r.Read(p)
 }
 
-func (i *tarInput) addFile(path string, info os.FileInfo, err error) error {
+// readSnapshot reads the snapshot the given level is based on. Without
+// snapshot, the whole tree gets archived.
+func (i *tarInput) readSnapshot(file, level string) error {
+	if file == "" {
+		if level != "" {
+			return fmt.Errorf("Level %s needs a snapshot", level)
+		}
+		return nil
+	}
+	i.snapshotFile = file
+	i.current = &snapshot{Files: make(map[string]fileState)}
+	var err error
+	switch level {
+	case levelFull:
+	case levelDifferential:
+		i.base, err = readSnapshot(file + ".0")
+		i.level = 1
+	case "", levelIncremental:
+		i.base, err = readSnapshot(file)
+		if i.base != nil {
+			i.level = i.base.Level + 1
+		}
+	default:
+		return fmt.Errorf("Invalid level %s", level)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't read snapshot: %s", err)
+	}
+	if i.base == nil {
+		log.Printf("No snapshot to base %s backup on, archiving everything", level)
+		i.level = 0
+	}
+	i.current.Level = i.level
+	return nil
+}
+
+// backupLevel returns 0 for full backups, otherwise 1 plus the level of
+// the backup it's based on.
+func (i *tarInput) backupLevel() int {
+	return i.level
+}
+
+// incremental returns true if a snapshot is kept.
+func (i *tarInput) incremental() bool {
+	return i.snapshotFile != ""
+}
+
+// commit stores the snapshot of the archived files, once the backup
+// succeeded. Full backups are also stored as base for differential ones.
+func (i *tarInput) commit() error {
+	if i.snapshotFile == "" {
+		return nil
+	}
+	if i.level == 0 {
+		if err := i.current.write(i.snapshotFile + ".0"); err != nil {
+			return err
+		}
+	}
+	return i.current.write(i.snapshotFile)
+}
+
+// addWhiteouts marks files deleted since the base snapshot.
+func (i *tarInput) addWhiteouts() error {
+	if i.base == nil {
+		return nil
+	}
+	for _, name := range i.base.deleted(i.current) {
+		dir, file := path.Split(name)
+		th := &tar.Header{
+			Name:       path.Join(filepath.Base(i.path), dir, whiteoutPrefix+file),
+			Typeflag:   tar.TypeReg,
+			Mode:       0600,
+			ModTime:    time.Now(),
+			PAXRecords: map[string]string{whiteoutRecord: "1"},
+			Format:     tar.FormatPAX,
+		}
+		log.Printf("deleted %s", name)
+		if err := i.tarWriter.WriteHeader(th); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort closes the pipe, which stops the walk.
+func (i *tarInput) Abort() error {
+	return i.r.CloseWithError(errAborted)
+}
+
+// addFile is called for directories before they are read, so excluded
+// directories are never read.
+func (i *tarInput) addFile(path string, d fs.DirEntry, err error) error {
 	log.Printf("file %s", path)
 	if err != nil {
 		return err
 	}
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	name, _ := filepath.Rel(i.path, path)
+	if name != "." {
+		skip, err := i.selector.skip(path, name, info)
+		if err != nil {
+			return err
+		}
+		if skip {
+			log.Printf("skipping %s", path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+	if i.current != nil {
+		name = filepath.ToSlash(name)
+		state := newFileState(info)
+		i.current.Files[name] = state
+		if i.base != nil && !info.IsDir() && i.base.unchanged(name, state) {
+			return nil
+		}
+	}
 
 	relPath := path[len(filepath.Dir(i.path))+1:] // relative to volume parent directory (<docker>/vfs/dir/)
-	th, err := tar.FileInfoHeader(info, relPath)
+	if info.Mode()&os.ModeSocket != 0 {
+		log.Printf("skipping socket %s", path)
+		return nil
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	th, err := tar.FileInfoHeader(info, link)
 	if err != nil {
 		return err
 	}
@@ -62,25 +225,53 @@ func (i *tarInput) addFile(path string, info os.FileInfo, err error) error {
 	if si, ok := info.Sys().(*syscall.Stat_t); ok {
 		th.Uid = int(si.Uid)
 		th.Gid = int(si.Gid)
+		if !info.IsDir() && si.Nlink > 1 {
+			id := fileID{dev: uint64(si.Dev), ino: uint64(si.Ino)}
+			if first, ok := i.links[id]; ok {
+				th.Typeflag = tar.TypeLink
+				th.Linkname = first
+				th.Size = 0
+			} else {
+				i.links[id] = relPath
+			}
+		}
 	}
-
-	if err := i.tarWriter.WriteHeader(th); err != nil {
-		return err
-	}
-
-	if !info.Mode().IsDir() && th.Typeflag != tar.TypeSymlink {
-		file, err := os.Open(path)
+	if th.Typeflag != tar.TypeSymlink && th.Typeflag != tar.TypeLink {
+		xattrs, err := listXattrs(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("Couldn't read extended attributes of %s: %s", path, err)
 		}
-		defer file.Close()
-		log.Printf("copying file %s", path)
-		if _, err := io.Copy(i.tarWriter, file); err != nil {
-			return err
+		for name, value := range xattrs {
+			if th.PAXRecords == nil {
+				th.PAXRecords = make(map[string]string)
+			}
+			th.PAXRecords["SCHILY.xattr."+name] = value
 		}
+	}
 
-		log.Printf("done!")
+	if th.Typeflag != tar.TypeReg {
+		return i.tarWriter.WriteHeader(th)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
+	regions, err := dataRegions(file, info)
+	if err != nil {
+		return fmt.Errorf("Couldn't find holes in %s: %s", path, err)
+	}
+	if regions != nil {
+		log.Printf("copying sparse file %s", path)
+		return writeSparse(i.tarWriter, i.w, th, file, regions)
+	}
+	if err := i.tarWriter.WriteHeader(th); err != nil {
+		return err
+	}
+	log.Printf("copying file %s", path)
+	if _, err := io.Copy(i.tarWriter, file); err != nil {
+		return err
+	}
+	log.Printf("done!")
 	return nil
-
 }
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// listXattrs returns the extended attributes of a file, including POSIX
+// ACLs stored as system.posix_acl_access and system.posix_acl_default.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(value[:size])
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
+
+// dataRegions returns the regions of a sparse file containing data, nil
+// if the file isn't sparse.
+func dataRegions(f *os.File, info os.FileInfo) ([]sparseRegion, error) {
+	si, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || si.Blocks*512 >= info.Size() {
+		return nil, nil
+	}
+	regions := []sparseRegion{}
+	for offset := int64(0); offset < info.Size(); {
+		data, err := f.Seek(offset, seekData)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			break // Only a hole left
+		}
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EINVAL {
+			return nil, nil // Not supported by the file system
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, sparseRegion{offset: data, length: hole - data})
+		offset = hole
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return regions, err
+}
+
+// mknod creates a device or FIFO.
+func mknod(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	major, minor := uint64(hdr.Devmajor), uint64(hdr.Devminor)
+	dev := (major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12
+	return syscall.Mknod(path, mode, int(dev))
+}
@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTarMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src", "data")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("Hello World"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "file"), filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(src, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := syscall.Setxattr(filepath.Join(src, "file"), "user.test", []byte("value"), 0) == nil
+	sparse, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sparse.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := sparse.Truncate(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	sparse.Close()
+	// Values looking like sparse records are kept as they are
+	sparseXattr := "1 GNU.sparse.size=1 GNU_sparse.major=2\n"
+	xattrs = xattrs && syscall.Setxattr(sparse.Name(), "user.sparse", []byte(sparseXattr), 0) == nil
+
+	in, err := newTarInput(map[string]string{"path": src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive) > 1<<20 {
+		t.Fatalf("Archive of sparse file has %d bytes", len(archive))
+	}
+	types := map[string]byte{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types[filepath.Base(h.Name)] = h.Typeflag
+	}
+	for name, typ := range map[string]byte{"symlink": tar.TypeSymlink, "fifo": tar.TypeFifo, "sparse": tar.TypeReg} {
+		if types[name] != typ {
+			t.Errorf("Expected %s to have type %c, got %c", name, typ, types[name])
+		}
+	}
+	if types["file"] != tar.TypeLink && types["link"] != tar.TypeLink {
+		t.Error("Expected hardlink")
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := os.Mkdir(restored, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := newUntarOutput(map[string]string{"path": restored})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(restored, "data")
+
+	file, err := os.Stat(filepath.Join(data, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(data, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(file, link) {
+		t.Error("Expected restored hardlink")
+	}
+	if target, err := os.Readlink(filepath.Join(data, "symlink")); err != nil || target != "file" {
+		t.Errorf("Unexpected symlink target %q: %v", target, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(data, "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected restored FIFO: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(data, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 4<<20 || string(content[1<<20:1<<20+4]) != "data" {
+		t.Error("Unexpected content of restored sparse file")
+	}
+	if xattrs {
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(filepath.Join(data, "file"), "user.test", value)
+		if err != nil || string(value[:n]) != "value" {
+			t.Errorf("Unexpected extended attribute %q: %v", value[:n], err)
+		}
+		value = make([]byte, 64)
+		n, err = syscall.Getxattr(filepath.Join(data, "sparse"), "user.sparse", value)
+		if err != nil || string(value[:n]) != sparseXattr {
+			t.Errorf("Unexpected extended attribute of sparse file %q: %v", value[:n], err)
+		}
+	}
+}
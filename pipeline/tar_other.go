@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package pipeline
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+)
+
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(path, name, value string) error {
+	return errors.New("Extended attributes are only supported on Linux")
+}
+
+func dataRegions(f *os.File, info os.FileInfo) ([]sparseRegion, error) {
+	return nil, nil
+}
+
+func mknod(path string, hdr *tar.Header) error {
+	return errors.New("Devices and FIFOs are only supported on Linux")
+}
@@ -2,43 +2,65 @@ package pipeline
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type untarOutput struct {
 	path string
 	tr   *tar.Reader
+	r    *io.PipeReader
 	w    io.WriteCloser
+	done chan error
 }
 
 func init() {
 	outputMap["untar"] = newUntarOutput
+	outputInverseMap["untar"] = inverseAs("tar", "path")
 }
 
 func newUntarOutput(conf map[string]string) (output, error) {
 	path := conf["path"]
+	if path == "" {
+		return nil, errors.New("path required")
+	}
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, fmt.Errorf("%s does not exist", path)
 	}
+	e, err := newExtractor(path, conf)
+	if err != nil {
+		return nil, err
+	}
 
 	r, w := io.Pipe()
 	tr := tar.NewReader(r)
 	ti := &untarOutput{
 		path: path,
+		r:    r,
 		w:    w,
 		tr:   tr,
+		done: make(chan error, 1),
 	}
-	go func(tr *tar.Reader, r *io.PipeReader, w *io.PipeWriter, path string) {
-		err := untar(tr, r, path)
+	go func(tr *tar.Reader, r *io.PipeReader) {
+		err := e.extract(tr)
+		if err == nil {
+			// Consume padding after the end of the archive
+			_, err = io.Copy(ioutil.Discard, r)
+		}
 		if err != nil {
+			// Writing returns err, which explains the failure
 			r.CloseWithError(err)
-			w.CloseWithError(err)
 		}
-	}(tr, r, w, path)
+		ti.done <- err
+	}(tr, r)
 	return ti, nil
 }
 
@@ -46,53 +68,274 @@ func (o *untarOutput) Write(p []byte) (n int, err error) {
 	return o.w.Write(p)
 }
 
+// Abort closes the pipe, which stops the extraction.
+func (o *untarOutput) Abort() error {
+	return o.r.CloseWithError(errAborted)
+}
+
+// Close waits for the extraction to finish and returns its error.
 func (o *untarOutput) Close() error {
-	return o.w.Close()
+	o.w.Close() // Never fails
+	return <-o.done
+}
+
+// extractor extracts tar archives to a directory. Entries can't be
+// written outside of it, neither by their name nor through symlinks.
+type extractor struct {
+	root            string
+	stripComponents int
+	sameOwner       bool
+	overwrite       bool
+	keepNewer       bool
+	selector        *entrySelector
+	dirs            []*tar.Header // Extracted, to set their modes and times last
 }
 
-func untar(tr *tar.Reader, r io.Reader, path string) error {
+// newExtractor returns an extractor configured by no_same_owner,
+// strip_components, overwrite, keep_newer, include and exclude.
+func newExtractor(root string, conf map[string]string) (*extractor, error) {
+	selector, err := newEntrySelector(conf)
+	if err != nil {
+		return nil, err
+	}
+	e := &extractor{
+		selector:  selector,
+		root:      root,
+		sameOwner: os.Geteuid() == 0 && conf["no_same_owner"] != "true",
+		overwrite: conf["overwrite"] != "false",
+		keepNewer: conf["keep_newer"] == "true",
+	}
+	if s := conf["strip_components"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid strip_components %s", s)
+		}
+		e.stripComponents = n
+	}
+	return e, nil
+}
+
+func (e *extractor) extract(tr *tar.Reader) error {
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
-			return nil
+			break
 		}
 		if err != nil {
 			return err
 		}
-		path := filepath.Join(path, hdr.Name)
-		info := hdr.FileInfo()
-		_, errOld := os.Lstat(path)
-		log.Print(path)
-		if info.IsDir() {
-			if os.IsNotExist(errOld) {
-				if err := os.Mkdir(path, info.Mode()); err != nil {
-					return err
-				}
-			}
-			if err := os.Chown(path, hdr.Uid, hdr.Gid); err != nil {
-				return err
-			}
-			if err := os.Chmod(path, info.Mode()); err != nil {
-				return err
-			}
-		} else {
-			file, err := os.Create(path)
-			if err != nil {
-				return err
-			}
-			if err := file.Chown(hdr.Uid, hdr.Gid); err != nil {
-				return err
-			}
-			if err := file.Chmod(info.Mode()); err != nil {
-				return err
-			}
-			if _, err := io.Copy(file, r); err != nil {
-				return err
-			}
-			if err := os.Chtimes(path, hdr.AccessTime, hdr.ModTime); err != nil { // doesn't work for directories?
+		if err := e.extractEntry(tr, hdr); err != nil {
+			return err
+		}
+	}
+	// Extracting contents changes the times of directories and needs
+	// write permission. Children come first, their parents may not be
+	// searchable anymore.
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		hdr := e.dirs[i]
+		if err := os.Chmod(hdr.Name, hdr.FileInfo().Mode()); err != nil {
+			return err
+		}
+		if err := chtimes(hdr.Name, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	if selected, err := e.selector.selected(hdr); !selected {
+		return err
+	}
+	path, err := e.target(hdr.Name)
+	if err != nil || path == "" {
+		return err
+	}
+	if path == filepath.Clean(e.root) && hdr.Typeflag != tar.TypeDir {
+		return fmt.Errorf("Unsafe entry %s in archive, would replace %s", hdr.Name, e.root)
+	}
+	if err := e.checkParents(path); err != nil {
+		return err
+	}
+	if hdr.PAXRecords[whiteoutRecord] == "1" {
+		dir, name := filepath.Split(path)
+		deleted := strings.TrimPrefix(name, whiteoutPrefix)
+		if deleted == name || deleted == "" || deleted == "." || deleted == ".." {
+			return fmt.Errorf("Invalid whiteout %s in archive", hdr.Name)
+		}
+		deleted = filepath.Join(dir, deleted)
+		log.Printf("deleting %s", deleted)
+		return os.RemoveAll(deleted)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	info := hdr.FileInfo()
+	old, errOld := os.Lstat(path)
+	if errOld == nil && (!old.IsDir() || !info.IsDir()) {
+		if !e.overwrite || e.keepNewer && old.ModTime().After(hdr.ModTime) {
+			log.Printf("keeping existing %s", path)
+			return nil
+		}
+		// Files are replaced instead of overwritten, which would follow
+		// symlinks and modify all hardlinks
+		if path == filepath.Clean(e.root) {
+			return fmt.Errorf("Refusing to replace %s", e.root)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		errOld = os.ErrNotExist
+	}
+	log.Print(path)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// The archived mode is set last, it may deny extracting contents
+		if os.IsNotExist(errOld) {
+			if err := os.Mkdir(path, 0700); err != nil {
 				return err
 			}
+		}
+		if err := e.chown(path, hdr); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, info.Mode()|0700); err != nil {
+			return err
+		}
+		dir := *hdr
+		dir.Name = path
+		e.dirs = append(e.dirs, &dir)
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		return e.chown(path, hdr)
+	case tar.TypeLink:
+		target, err := e.target(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return fmt.Errorf("Hardlink %s to stripped %s", hdr.Name, hdr.Linkname)
+		}
+		if err := e.checkParents(target); err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mknod(path, hdr); err != nil {
+			return err
+		}
+		if err := e.chown(path, hdr); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, info.Mode()); err != nil {
+			return err
+		}
+		if err := chtimes(path, hdr); err != nil {
+			return err
+		}
+	default:
+		if err := e.extractFile(tr, hdr, path); err != nil {
+			return err
+		}
+		if err := chtimes(path, hdr); err != nil {
+			return err
+		}
+	}
+	// After chown, which clears capabilities
+	return untarXattrs(hdr, path)
+}
+
+func (e *extractor) extractFile(tr *tar.Reader, hdr *tar.Header, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if e.sameOwner {
+		if err := file.Chown(hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if err := file.Chmod(hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, tr); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// target returns the path to extract the entry with the given name to,
+// empty if it's stripped entirely. Leading slashes are removed, names
+// with .. are rejected.
+func (e *extractor) target(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Unsafe path %s in archive", name)
+		}
+	}
+	name = entryName(name)
+	if e.stripComponents > 0 {
+		parts := strings.Split(name, "/")
+		if name == "" || len(parts) <= e.stripComponents {
+			return "", nil
+		}
+		name = path.Join(parts[e.stripComponents:]...)
+	}
+	return filepath.Join(e.root, filepath.FromSlash(name)), nil
+}
 
+// checkParents fails if a parent directory of path below the root is a
+// symlink, which could point outside of it.
+func (e *extractor) checkParents(path string) error {
+	rel, err := filepath.Rel(e.root, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := e.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to extract %s through symlink %s", path, dir)
+		}
+	}
+	return nil
+}
+
+func (e *extractor) chown(path string, hdr *tar.Header) error {
+	if !e.sameOwner {
+		return nil
+	}
+	return os.Lchown(path, hdr.Uid, hdr.Gid)
+}
+
+func chtimes(path string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(path, atime, hdr.ModTime)
+}
+
+// untarXattrs restores the extended attributes stored as PAX records.
+func untarXattrs(hdr *tar.Header, path string) error {
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "SCHILY.xattr.")
+		if err := setXattr(path, name, value); err != nil {
+			return fmt.Errorf("Couldn't set extended attribute %s of %s: %s", name, path, err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,249 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testArchive returns an archive of the given headers. Regular files
+// contain their name.
+func testArchive(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			io.WriteString(tw, h.Name)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// extractTestArchive extracts an archive of the given headers to root.
+func extractTestArchive(t *testing.T, root string, conf map[string]string, headers ...*tar.Header) error {
+	buf := testArchive(t, headers...)
+	conf["path"] = root
+	out, err := newUntarOutput(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, buf); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func TestUntarUnsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	precious := filepath.Join(root, "precious")
+	if err := ioutil.WriteFile(precious, []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		headers []*tar.Header
+		err     string
+	}{
+		{[]*tar.Header{{Name: "../escaped", Typeflag: tar.TypeReg}}, "Unsafe path ../escaped in archive"},
+		{[]*tar.Header{{Name: "a/../../escaped", Typeflag: tar.TypeReg}}, "Unsafe path a/../../escaped in archive"},
+		{[]*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: dir}, {Name: "link/escaped", Typeflag: tar.TypeReg}}, "through symlink"},
+		{[]*tar.Header{{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../escaped"}}, "Unsafe path ../escaped in archive"},
+		{[]*tar.Header{{Name: ".wh..", Typeflag: tar.TypeReg, PAXRecords: map[string]string{whiteoutRecord: "1"}}}, "Invalid whiteout .wh.. in archive"},
+		{[]*tar.Header{{Name: ".", Typeflag: tar.TypeReg}}, "Unsafe entry . in archive"},
+		{[]*tar.Header{{Name: "/", Typeflag: tar.TypeSymlink, Linkname: dir}}, "Unsafe entry / in archive"},
+	} {
+		headers := tc.headers
+		if err := extractTestArchive(t, root, map[string]string{}, headers...); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected extracting %s to fail with %q, got %v", headers[len(headers)-1].Name, tc.err, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "escaped")); err == nil {
+			t.Fatalf("Extracting %s escaped the root", headers[len(headers)-1].Name)
+		}
+		if _, err := os.Stat(precious); err != nil {
+			t.Fatalf("Extracting %s removed the root: %s", headers[len(headers)-1].Name, err)
+		}
+	}
+}
+
+func TestUntarOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Missing parents are created, directory times set after contents
+	if err := extractTestArchive(t, dir, map[string]string{"strip_components": "1", "no_same_owner": "true"},
+		&tar.Header{Name: "top", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "top/a", Typeflag: tar.TypeDir, ModTime: mtime},
+		&tar.Header{Name: "top/a/b/c", Typeflag: tar.TypeReg, ModTime: mtime},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if content := read("a/b/c"); content != "top/a/b/c" {
+		t.Fatalf("Unexpected content %q", content)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("Unexpected time of directory: %v %v", info.ModTime(), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "top")); err == nil {
+		t.Fatal("Expected stripped entry to be skipped")
+	}
+
+	// Only selected entries are extracted
+	if err := extractTestArchive(t, dir, map[string]string{"include": "/x/", "exclude": "*.log"},
+		&tar.Header{Name: "x/keep", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "x/skip.log", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "y/skip", Typeflag: tar.TypeReg},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if content := read("x/keep"); content != "x/keep" {
+		t.Fatalf("Unexpected content %q", content)
+	}
+	for _, name := range []string{"x/skip.log", "y"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("Expected %s to be skipped", name)
+		}
+	}
+
+	// Only whiteouts marked as such delete files
+	if err := extractTestArchive(t, dir, map[string]string{}, &tar.Header{Name: "x/.wh.keep", Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if content := read("x/keep") + read("x/.wh.keep"); content != "x/keepx/.wh.keep" {
+		t.Fatalf("Unexpected content %q", content)
+	}
+	if err := extractTestArchive(t, dir, map[string]string{},
+		&tar.Header{Name: "x/.wh.keep", Typeflag: tar.TypeReg, PAXRecords: map[string]string{whiteoutRecord: "1"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x/keep")); !os.IsNotExist(err) {
+		t.Fatalf("Expected whiteout to delete x/keep: %v", err)
+	}
+
+	// Existing files are kept if they're newer or overwriting is disabled
+	for _, tc := range []struct {
+		conf     map[string]string
+		mtime    time.Time
+		expected string
+	}{
+		{map[string]string{}, mtime, "a/b/c"},
+		{map[string]string{"keep_newer": "true"}, mtime, "existing"},
+		{map[string]string{"keep_newer": "true"}, time.Now().Add(time.Hour), "a/b/c"},
+		{map[string]string{"overwrite": "false"}, time.Now().Add(time.Hour), "existing"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "a/b/c"), []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractTestArchive(t, dir, tc.conf, &tar.Header{Name: "a/b/c", Typeflag: tar.TypeReg, ModTime: tc.mtime}); err != nil {
+			t.Fatal(err)
+		}
+		if content := read("a/b/c"); !strings.HasSuffix(content, tc.expected) {
+			t.Errorf("Unexpected content %q with %v, expected %q", content, tc.conf, tc.expected)
+		}
+	}
+}
+
+func TestUntarReadOnlyDir(t *testing.T) {
+	// Root can write to read-only directories anyway
+	if os.Geteuid() == 0 {
+		runAsNobody(t, "TestUntarReadOnlyDir")
+		return
+	}
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+
+	if err := extractTestArchive(t, dir, map[string]string{},
+		&tar.Header{Name: "ro", Typeflag: tar.TypeDir, Mode: 0555},
+		&tar.Header{Name: "ro/sub", Typeflag: tar.TypeDir, Mode: 0500},
+		&tar.Header{Name: "ro/sub/file", Typeflag: tar.TypeReg},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "ro/sub/file")); err != nil || string(data) != "ro/sub/file" {
+		t.Fatalf("Unexpected content %q: %v", data, err)
+	}
+	for name, mode := range map[string]os.FileMode{"ro": 0555, "ro/sub": 0500} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("Unexpected mode of %s: %v %v", name, info.Mode(), err)
+		}
+	}
+}
+
+// runAsNobody runs the given test in a copy of the test binary as user
+// nobody.
+func runAsNobody(t *testing.T, name string) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(bin, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "-test.run", "^"+name+"$")
+	cmd.Dir = os.TempDir()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s failed as nobody: %s\n%s", name, err, out)
+	}
+}
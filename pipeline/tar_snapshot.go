@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+const (
+	levelFull         = "full"
+	levelDifferential = "differential"
+	levelIncremental  = "incremental"
+
+	// whiteoutPrefix marks deleted files in incremental archives, like in
+	// Docker image layers: dir/.wh.name deletes dir/name.
+	whiteoutPrefix = ".wh."
+	// whiteoutRecord is the PAX record set to "1" on whiteouts, so files
+	// which happen to start with the prefix are never taken for one.
+	whiteoutRecord = "BYTEPIPER.whiteout"
+)
+
+// fileState identifies a version of a file.
+type fileState struct {
+	Inode   uint64 `json:"inode"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Size    int64  `json:"size"`
+	Dir     bool   `json:"dir,omitempty"`
+}
+
+func newFileState(info os.FileInfo) fileState {
+	s := fileState{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Dir:     info.IsDir(),
+	}
+	if si, ok := info.Sys().(*syscall.Stat_t); ok {
+		s.Inode = uint64(si.Ino)
+	}
+	return s
+}
+
+// snapshot records the state of all archived files by their slash
+// separated path relative to the archived directory, like the
+// listed-incremental file of GNU tar.
+type snapshot struct {
+	Level int                  `json:"level"`
+	Files map[string]fileState `json:"files"`
+}
+
+// readSnapshot reads a snapshot file, returning nil if it doesn't exist.
+func readSnapshot(file string) (*snapshot, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{}
+	return s, json.Unmarshal(data, s)
+}
+
+// write replaces the snapshot file atomically.
+func (s *snapshot) write(file string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// unchanged returns true if the file is in the snapshot in the given
+// state.
+func (s *snapshot) unchanged(name string, state fileState) bool {
+	old, ok := s.Files[name]
+	return ok && old == state
+}
+
+// deleted returns the files in the snapshot missing in current, sorted.
+// Files in deleted directories aren't included, deleting the directory
+// deletes them too.
+func (s *snapshot) deleted(current *snapshot) []string {
+	deleted := []string{}
+	for name := range s.Files {
+		if _, ok := current.Files[name]; ok {
+			continue
+		}
+		if parent, ok := current.Files[path.Dir(name)]; ok && parent.Dir {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTarIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", tempPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "data")
+	backups := filepath.Join(dir, "backups")
+	for _, d := range []string{filepath.Join(src, "sub"), backups} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "a")
+	write("b.txt", "b")
+	write("sub/c.txt", "c")
+
+	configFile := filepath.Join(dir, "backup.json")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`{
+		"name": "incremental",
+		"catalog": %q,
+		"input": {"type": "tar", "config": {"path": %q, "snapshot": %q, "level": "incremental"}},
+		"output": {"type": "file", "config": {"path": %q}}
+	}`, filepath.Join(dir, "catalog"), src, filepath.Join(dir, "snapshot"), filepath.Join(backups, "{{.Time.UnixNano}}.tar"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup := func() *Manifest {
+		p, err := New(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Run(); err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := ReadCatalog(filepath.Join(dir, "catalog"), "incremental")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifests[len(manifests)-1]
+	}
+	entries := func(m *Manifest) []string {
+		f, err := os.Open(m.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		names := []string{}
+		tr := tar.NewReader(f)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, h.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if m := backup(); m.Level != 0 {
+		t.Fatalf("Expected full backup without snapshot, got level %d", m.Level)
+	}
+	write("a.txt", "changed")
+	write("d.txt", "new")
+	if err := os.Remove(filepath.Join(src, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	m := backup()
+	expected := []string{"data", "data/.wh.b.txt", "data/a.txt", "data/d.txt", "data/sub"}
+	if names := entries(m); m.Level != 1 || !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Unexpected level %d backup %v, expected level 1 %v", m.Level, names, expected)
+	}
+	if err := os.RemoveAll(filepath.Join(src, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	m = backup()
+	expected = []string{"data", "data/.wh.sub"}
+	if names := entries(m); m.Level != 2 || !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Unexpected level %d backup %v, expected level 2 %v", m.Level, names, expected)
+	}
+
+	chain, err := RestoreChain(configFile, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || chain[0].Level != 0 || chain[2] != m {
+		t.Fatalf("Unexpected chain %v", chain)
+	}
+	restored := filepath.Join(dir, "restored")
+	if err := os.Mkdir(restored, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("OUTPUT_path", restored)
+	defer os.Unsetenv("OUTPUT_path")
+	for _, m := range chain {
+		p, err := NewRestoreManifest(configFile, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{}
+	filepath.Walk(filepath.Join(restored, "data"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			data, _ := ioutil.ReadFile(path)
+			files[info.Name()] = string(data)
+		}
+		return err
+	})
+	if expected := map[string]string{"a.txt": "changed", "d.txt": "new"}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Unexpected restored files %v, expected %v", files, expected)
+	}
+}
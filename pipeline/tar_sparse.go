@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tarBlockSize = 512
+
+// sparseRegion is a part of a sparse file containing data.
+type sparseRegion struct {
+	offset, length int64
+}
+
+// writeSparse writes a sparse file in the PAX 1.0 sparse format of GNU tar,
+// storing only the data regions. archive/tar reads, but doesn't write
+// this format, so the entry is written to w directly.
+func writeSparse(tw *tar.Writer, w io.Writer, th *tar.Header, f *os.File, regions []sparseRegion) error {
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < th.Size {
+		// Trailing hole, which GNU tar expects as empty region
+		regions = append(regions, sparseRegion{offset: th.Size})
+	}
+	sparseMap := strconv.Itoa(len(regions)) + "\n"
+	size := int64(0)
+	for _, r := range regions {
+		sparseMap += fmt.Sprintf("%d\n%d\n", r.offset, r.length)
+		size += r.length
+	}
+	sparseMap += strings.Repeat("\x00", padding(int64(len(sparseMap))))
+
+	dir, file := path.Split(th.Name)
+	hdr := *th
+	hdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+	hdr.Size = int64(len(sparseMap)) + size
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     th.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(th.Size, 10),
+	}
+	for k, v := range th.PAXRecords {
+		records[k] = v
+	}
+	// Pending padding of the previous entry goes first
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := writePAXHeader(w, &hdr, records); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, sparseMap); err != nil {
+		return err
+	}
+	for _, r := range regions {
+		if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f, r.length); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(make([]byte, padding(size)))
+	return err
+}
+
+// writePAXHeader writes a PAX extended header with the given records and
+// the ustar header of hdr, which archive/tar won't do for GNU.sparse
+// records. Values not fitting into the ustar header are added as records.
+func writePAXHeader(w io.Writer, hdr *tar.Header, records map[string]string) error {
+	if len(hdr.Name) > 100 {
+		records["path"] = hdr.Name
+	}
+	for key, value := range map[string]int64{"size": hdr.Size, "uid": int64(hdr.Uid), "gid": int64(hdr.Gid)} {
+		max := int64(07777777)
+		if key == "size" {
+			max = 077777777777
+		}
+		if value > max {
+			records[key] = strconv.FormatInt(value, 10)
+		}
+	}
+	for key, value := range map[string]string{"uname": hdr.Uname, "gname": hdr.Gname} {
+		if len(value) > 32 {
+			records[key] = value
+		}
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := &bytes.Buffer{}
+	for _, key := range keys {
+		data.WriteString(paxRecord(key, records[key]))
+	}
+
+	dir, file := path.Split(hdr.Name)
+	xhdr := &tar.Header{
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Typeflag: tar.TypeXHeader,
+		Mode:     0644,
+		Size:     int64(data.Len()),
+		ModTime:  hdr.ModTime,
+	}
+	if _, err := w.Write(ustarBlock(xhdr)); err != nil {
+		return err
+	}
+	data.Write(make([]byte, padding(int64(data.Len()))))
+	if _, err := w.Write(data.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(ustarBlock(hdr))
+	return err
+}
+
+// paxRecord formats a PAX record, prefixed by its own length.
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	n := len(record)
+	for n != len(strconv.Itoa(n))+len(record) {
+		n = len(strconv.Itoa(n)) + len(record)
+	}
+	return strconv.Itoa(n) + record
+}
+
+// ustarBlock returns the ustar header block of hdr. Fields which don't
+// fit are truncated or zeroed, they must be in a PAX header.
+func ustarBlock(hdr *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+	str := func(b []byte, s string) {
+		copy(b[:len(b)-1], s)
+	}
+	octal := func(b []byte, n int64) {
+		s := strconv.FormatInt(n, 8)
+		if n < 0 || len(s) > len(b)-1 {
+			s = "0"
+		}
+		copy(b, fmt.Sprintf("%0*s", len(b)-1, s))
+	}
+	str(block[0:100], hdr.Name)
+	octal(block[100:108], hdr.Mode&07777)
+	octal(block[108:116], int64(hdr.Uid))
+	octal(block[116:124], int64(hdr.Gid))
+	octal(block[124:136], hdr.Size)
+	octal(block[136:148], hdr.ModTime.Unix())
+	block[156] = hdr.Typeflag
+	copy(block[257:265], "ustar\x0000")
+	str(block[265:297], hdr.Uname)
+	str(block[297:329], hdr.Gname)
+
+	copy(block[148:156], "        ")
+	sum := int64(0)
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// padding returns the number of bytes needed to fill the last block.
+func padding(size int64) int {
+	return int(-size & (tarBlockSize - 1))
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	templateFuncs = template.FuncMap{
+		"strftime": strftime,
+	}
+
+	// templateKeys are the config keys expanded as templates. Others,
+	// like passphrases and patterns, are taken literally.
+	templateKeys = map[string]bool{
+		"path":     true,
+		"filename": true,
+		"bucket":   true,
+		"snapshot": true,
+		"mtime":    true,
+	}
+)
+
+// Vars are available in config values as Go template, like
+// {{.Name}}-{{strftime "%Y%m%d" .Time}}. Only the time differs between
+// runs, even across restarts, so it's what makes locations unique.
+type Vars struct {
+	Time     time.Time // Start of the run
+	Hostname string
+	Name     string // Name of the pipeline
+}
+
+func newVars(name string) (*Vars, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &Vars{
+		Time:     time.Now(),
+		Hostname: hostname,
+		Name:     name,
+	}, nil
+}
+
+// nameFromPath returns the file name without extension.
+func nameFromPath(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// expand returns a copy of the config with the values of templateKeys
+// expanded as templates.
+func (v *Vars) expand(conf map[string]string) (map[string]string, error) {
+	expanded := make(map[string]string, len(conf))
+	for key, value := range conf {
+		if !templateKeys[key] {
+			expanded[key] = value
+			continue
+		}
+		var err error
+		if expanded[key], err = v.expandValue(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// expandValue expands the value of the given key as template.
+func (v *Vars) expandValue(key, value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New(key).Funcs(templateFuncs).Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("Invalid template in %s: %s", key, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, v); err != nil {
+		return "", fmt.Errorf("Couldn't expand %s: %s", key, err)
+	}
+	return buf.String(), nil
+}
+
+// strftime formats the time according to the given strftime(3) format,
+// supporting the most common conversions.
+func strftime(format string, t time.Time) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			buf.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			buf.WriteString(t.Format("2006"))
+		case 'y':
+			buf.WriteString(t.Format("06"))
+		case 'm':
+			buf.WriteString(t.Format("01"))
+		case 'd':
+			buf.WriteString(t.Format("02"))
+		case 'H':
+			buf.WriteString(t.Format("15"))
+		case 'M':
+			buf.WriteString(t.Format("04"))
+		case 'S':
+			buf.WriteString(t.Format("05"))
+		case 'b':
+			buf.WriteString(t.Format("Jan"))
+		case 'a':
+			buf.WriteString(t.Format("Mon"))
+		case 'j':
+			fmt.Fprintf(buf, "%03d", t.YearDay())
+		case 'z':
+			buf.WriteString(t.Format("-0700"))
+		case 'Z':
+			buf.WriteString(t.Format("MST"))
+		case 's':
+			buf.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'F':
+			buf.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			buf.WriteString(t.Format("15:04:05"))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(format[i])
+		}
+	}
+	return buf.String()
+}
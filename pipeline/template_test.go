@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVarsExpand(t *testing.T) {
+	vars := &Vars{
+		Time:     time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC),
+		Hostname: "db1",
+		Name:     "db",
+	}
+	conf, err := vars.expand(map[string]string{
+		"filename":   `{{.Name}}/{{strftime "%Y/%m/%d" .Time}}/{{.Name}}-{{strftime "%H%M" .Time}}.sql.gz.gpg`,
+		"path":       `/backup/{{.Hostname}}-{{.Time.Format "20060102"}}-{{.Time.Unix}}.tar`,
+		"command":    `awk '{print $1}'`,
+		"passphrase": `{{secret`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"filename":   "db/2026/10/18/db-0300.sql.gz.gpg",
+		"path":       "/backup/db1-20261018-1792292400.tar",
+		"command":    `awk '{print $1}'`,
+		"passphrase": `{{secret`,
+	} {
+		if conf[key] != expected {
+			t.Fatalf("Unexpected %s: %s != %s", key, conf[key], expected)
+		}
+	}
+}
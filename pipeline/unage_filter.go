@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+func init() {
+	filterMap["unage"] = newUnageFilter
+	filterInverseMap["unage"] = inverseAs("age", "work_factor")
+}
+
+// newUnageFilter returns a filter decrypting with the identities in
+// identity or identity_file, either age keys or an unencrypted SSH
+// private key, or with the passphrase.
+func newUnageFilter(conf map[string]string) (filter, error) {
+	identities := []age.Identity{}
+	for _, key := range []string{"identity", "identity_file"} {
+		data := []byte(conf[key])
+		if key == "identity_file" && conf[key] != "" {
+			var err error
+			if data, err = ioutil.ReadFile(conf[key]); err != nil {
+				return nil, fmt.Errorf("Couldn't read identity_file: %s", err)
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		ids, err := parseAgeIdentities(data)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read %s: %s", key, err)
+		}
+		identities = append(identities, ids...)
+	}
+	passphrase, err := readPassphrase(conf, "passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != nil {
+		id, err := age.NewScryptIdentity(string(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		if conf["work_factor"] != "" {
+			n, err := strconv.Atoi(conf["work_factor"])
+			if err != nil || n < 1 || n > 30 {
+				return nil, fmt.Errorf("Invalid work_factor %s", conf["work_factor"])
+			}
+			id.SetMaxWorkFactor(n)
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("identity, identity_file or passphrase required")
+	}
+	return &decompressFilter{newReader: func(r io.Reader) (io.Reader, error) {
+		return age.Decrypt(r, identities...)
+	}}, nil
+}
+
+func parseAgeIdentities(data []byte) ([]age.Identity, error) {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		id, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{id}, nil
+	}
+	return age.ParseIdentities(bytes.NewReader(data))
+}
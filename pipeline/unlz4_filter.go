@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func init() {
+	filterMap["unlz4"] = newUnlz4Filter
+	filterInverseMap["unlz4"] = inverseAs("lz4")
+}
+
+func newUnlz4Filter(map[string]string) (filter, error) {
+	return &decompressFilter{newReader: func(r io.Reader) (io.Reader, error) {
+		return lz4.NewReader(r), nil
+	}}, nil
+}
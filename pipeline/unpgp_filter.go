@@ -1,7 +1,6 @@
 package pipeline
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -12,36 +11,59 @@ import (
 
 func init() {
 	filterMap["unpgp"] = newUnpgpFilter
+	filterInverseMap["unpgp"] = inverseAs("pgp")
 }
 
 type unpgpFilter struct {
 	r       io.Reader
 	ready   chan bool
 	keyRing openpgp.KeyRing
+	trusted openpgp.EntityList
+	message *openpgp.MessageDetails
+
+	passphrase []byte
+	tried      bool // Whether the passphrase was tried for symmetric decryption
 }
 
+// newUnpgpFilter returns a filter decrypting with the keys in privatkey
+// and privatkey_file. The passphrase decrypts encrypted private keys and
+// symmetrically encrypted messages.
 func newUnpgpFilter(conf map[string]string) (filter, error) {
-	if conf["privatkey"] == "" {
-		return nil, errors.New("privatkey required")
+	keyRing, err := readKeyRing(conf, "privatkey")
+	if err != nil {
+		return nil, err
 	}
-	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewBuffer([]byte(conf["privatkey"])))
+	passphrase, err := readPassphrase(conf, "passphrase")
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read privatkey: %s", err)
+		return nil, err
+	}
+	if keyRing == nil && passphrase == nil {
+		return nil, errors.New("privatkey, privatkey_file or passphrase required")
 	}
 
-	return &unpgpFilter{
-		keyRing: keyRing,
-		ready:   make(chan bool),
-	}, nil
+	f := &unpgpFilter{
+		keyRing:    keyRing,
+		ready:      make(chan bool),
+		passphrase: passphrase,
+	}
+	if f.trusted, err = readKeyRing(conf, "trusted_keys"); err != nil {
+		return nil, err
+	}
+	if f.trusted != nil {
+		// Signatures are checked against the keys of the key ring
+		f.keyRing = append(keyRing, f.trusted...)
+	}
+	return f, nil
 }
 
 func (f *unpgpFilter) Link(r io.Reader) error {
 	log.Print("openpgp.ReadMessage")
-	message, err := openpgp.ReadMessage(r, f.keyRing, nil, nil)
+	message, err := openpgp.ReadMessage(r, f.keyRing, f.prompt, nil)
 	if err != nil {
 		return err
 	}
 	f.r = message.UnverifiedBody
+	f.message = message
 	return nil
 }
 
@@ -49,5 +71,52 @@ func (f *unpgpFilter) Read(p []byte) (n int, err error) {
 	if f.r == nil {
 		return 0, errors.New("Couldn't decrypt message")
 	}
-	return f.r.Read(p)
+	n, err = f.r.Read(p)
+	if err == io.EOF && f.trusted != nil {
+		if err := f.verify(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// prompt is called by openpgp if the message can only be decrypted with
+// encrypted private keys or is encrypted symmetrically. It gets called
+// again if decryption failed, so the passphrase is only tried once.
+func (f *unpgpFilter) prompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	if f.passphrase == nil {
+		return nil, errors.New("Private key or message is encrypted, but no passphrase given")
+	}
+	if symmetric {
+		if f.tried {
+			return nil, errors.New("Couldn't decrypt message with passphrase")
+		}
+		f.tried = true
+		return f.passphrase, nil
+	}
+	for _, key := range keys {
+		if err := key.PrivateKey.Decrypt(f.passphrase); err != nil {
+			return nil, fmt.Errorf("Couldn't decrypt private key: %s", err)
+		}
+	}
+	return nil, nil
+}
+
+// verify checks the signature of the message, which is only possible
+// once the body was read completely.
+func (f *unpgpFilter) verify() error {
+	m := f.message
+	if !m.IsSigned {
+		return errors.New("Message isn't signed")
+	}
+	if len(f.trusted.KeysById(m.SignedByKeyId)) == 0 {
+		return fmt.Errorf("Message is signed by untrusted key %X", m.SignedByKeyId)
+	}
+	if m.SignatureError != nil {
+		return fmt.Errorf("Invalid signature: %s", m.SignatureError)
+	}
+	if m.Signature == nil && m.SignatureV3 == nil {
+		return errors.New("Missing signature")
+	}
+	return nil
 }
@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	filterMap["unxz"] = newUnxzFilter
+	filterInverseMap["unxz"] = inverseAs("xz")
+}
+
+func newUnxzFilter(map[string]string) (filter, error) {
+	return &decompressFilter{newReader: func(r io.Reader) (io.Reader, error) {
+		return xz.NewReader(r)
+	}}, nil
+}
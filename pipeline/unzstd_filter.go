@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	filterMap["unzstd"] = newUnzstdFilter
+	filterInverseMap["unzstd"] = inverseAs("zstd", "dictionary")
+}
+
+type unzstdFilter struct {
+	opts []zstd.DOption
+	d    *zstd.Decoder
+}
+
+// newUnzstdFilter returns a zstd decompressing filter. Options: threads
+// and dictionary (path to the dictionary used for compression). Windows
+// up to 512MB are supported, so long mode needs no option.
+func newUnzstdFilter(conf map[string]string) (filter, error) {
+	opts := []zstd.DOption{}
+	if threads := conf["threads"]; threads != "" {
+		n, err := strconv.Atoi(threads)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid number of threads %s", threads)
+		}
+		opts = append(opts, zstd.WithDecoderConcurrency(n))
+	}
+	if file := conf["dictionary"]; file != "" {
+		dict, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read dictionary: %s", err)
+		}
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	return &unzstdFilter{opts: opts}, nil
+}
+
+func (f *unzstdFilter) Link(r io.Reader) error {
+	d, err := zstd.NewReader(r, f.opts...)
+	f.d = d
+	return err
+}
+
+// Read closes the decoder once all data was read, stopping its
+// goroutines.
+func (f *unzstdFilter) Read(p []byte) (n int, err error) {
+	n, err = f.d.Read(p)
+	if err != nil {
+		f.d.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keySourceVault      = 3
+	defaultVaultMount   = "transit"
+	vaultRequestTimeout = 30 * time.Second
+)
+
+// vaultKey generates a data key per stream with Vault's transit secrets
+// engine. The data key, wrapped by the transit key, is stored in the
+// stream header together with the key name and unwrapped by Vault to
+// decrypt. Since Vault can unwrap with older versions of a rotated key,
+// old backups stay readable without re-encrypting them.
+type vaultKey struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	name      string
+	client    *http.Client
+}
+
+// newVaultKey returns a Vault key source. Options: vault_addr and
+// vault_token (default to VAULT_ADDR and VAULT_TOKEN), vault_namespace,
+// vault_mount (default transit) and vault_key, the name of the transit
+// key, required to encrypt.
+func newVaultKey(conf map[string]string) (*vaultKey, error) {
+	k := &vaultKey{
+		addr:      conf["vault_addr"],
+		namespace: conf["vault_namespace"],
+		mount:     conf["vault_mount"],
+		name:      conf["vault_key"],
+		client:    &http.Client{Timeout: vaultRequestTimeout},
+	}
+	if k.addr == "" {
+		k.addr = os.Getenv("VAULT_ADDR")
+	}
+	if k.addr == "" {
+		return nil, errors.New("vault_addr or VAULT_ADDR required")
+	}
+	token, err := readPassphrase(conf, "vault_token")
+	if err != nil {
+		return nil, err
+	}
+	k.token = string(token)
+	if k.token == "" {
+		k.token = os.Getenv("VAULT_TOKEN")
+	}
+	if k.token == "" {
+		return nil, errors.New("vault_token or VAULT_TOKEN required")
+	}
+	if k.mount == "" {
+		k.mount = defaultVaultMount
+	}
+	return k, nil
+}
+
+func (k *vaultKey) id() byte { return keySourceVault }
+
+// newKey returns a new data key. The params are the length of the key
+// name, the key name and the wrapped data key.
+func (k *vaultKey) newKey() ([]byte, []byte, error) {
+	if k.name == "" {
+		return nil, nil, errors.New("vault_key required")
+	}
+	resp := struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}{}
+	if err := k.do("datakey/plaintext/"+k.name, map[string]string{"bits": "256"}, &resp); err != nil {
+		return nil, nil, fmt.Errorf("Couldn't generate data key: %s", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid data key: %s", err)
+	}
+	if len(k.name) > 255 {
+		return nil, nil, errors.New("vault_key too long")
+	}
+	params := append([]byte{byte(len(k.name))}, k.name...)
+	return key, append(params, resp.Ciphertext...), nil
+}
+
+func (k *vaultKey) key(params []byte) ([]byte, error) {
+	if len(params) < 1 || len(params) < 1+int(params[0]) {
+		return nil, errors.New("Invalid vault params")
+	}
+	name := string(params[1 : 1+params[0]])
+	resp := struct {
+		Plaintext string `json:"plaintext"`
+	}{}
+	if err := k.do("decrypt/"+name, map[string]string{"ciphertext": string(params[1+params[0]:])}, &resp); err != nil {
+		return nil, fmt.Errorf("Couldn't unwrap data key with %s: %s", name, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// do posts the request to the transit path and decodes the data of the
+// response into data.
+func (k *vaultKey) do(path string, req interface{}, data interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s", strings.TrimSuffix(k.addr, "/"), k.mount, path)
+	r, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Vault-Token", k.token)
+	if k.namespace != "" {
+		r.Header.Set("X-Vault-Namespace", k.namespace)
+	}
+	resp, err := k.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	result := struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("Couldn't decode response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(result.Errors, ", "))
+	}
+	return json.Unmarshal(result.Data, data)
+}
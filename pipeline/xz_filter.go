@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	filterMap["xz"] = newXzFilter
+	filterInverseMap["xz"] = inverseAs("unxz")
+}
+
+func newXzFilter(map[string]string) (filter, error) {
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	}}, nil
+}
@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultLongWindowLog is the window log used if long is true, same as
+// zstd --long.
+const defaultLongWindowLog = 27
+
+func init() {
+	filterMap["zstd"] = newZstdFilter
+	filterInverseMap["zstd"] = inverseAs("unzstd", "dictionary")
+}
+
+// newZstdFilter returns a zstd compressing filter. Options:
+// level (1-22 or fastest, default, better, best), threads, long (true or
+// the window log) and dictionary (path to a dictionary trained by
+// zstd --train).
+func newZstdFilter(conf map[string]string) (filter, error) {
+	opts := []zstd.EOption{}
+	if level := conf["level"]; level != "" {
+		ok, l := zstd.EncoderLevelFromString(level)
+		if !ok {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 1 || n > 22 {
+				return nil, fmt.Errorf("Invalid zstd level %s", level)
+			}
+			l = zstd.EncoderLevelFromZstd(n)
+		}
+		opts = append(opts, zstd.WithEncoderLevel(l))
+	}
+	if threads := conf["threads"]; threads != "" {
+		n, err := strconv.Atoi(threads)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid number of threads %s", threads)
+		}
+		opts = append(opts, zstd.WithEncoderConcurrency(n))
+	}
+	if long := conf["long"]; long != "" && long != "false" {
+		windowLog := defaultLongWindowLog
+		if long != "true" {
+			n, err := strconv.Atoi(long)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid long %s", long)
+			}
+			windowLog = n
+		}
+		if windowLog < 10 || windowLog > 29 {
+			return nil, fmt.Errorf("Invalid window log %d, must be between 10 and 29", windowLog)
+		}
+		opts = append(opts, zstd.WithWindowSize(1<<uint(windowLog)))
+	}
+	if file := conf["dictionary"]; file != "" {
+		dict, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read dictionary: %s", err)
+		}
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	// Validate options now instead of failing the run
+	zw, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zw.Close()
+	return &compressFilter{newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, opts...)
+	}}, nil
+}
@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFilterZstd(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World "), 100000)
+	for _, conf := range []map[string]string{
+		{},
+		{"level": "19", "threads": "1"},
+		{"level": "fastest", "long": "true"},
+	} {
+		zstd, err := newZstdFilter(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := zstd.Link(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		unzstd, err := newUnzstdFilter(map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unzstd.Link(zstd); err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if _, err := io.Copy(out, unzstd); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("Unexpected output with %v", conf)
+		}
+	}
+}
+
+func TestFilterZstdInvalid(t *testing.T) {
+	for _, conf := range []map[string]string{
+		{"level": "23"},
+		{"threads": "0"},
+		{"long": "31"},
+		{"dictionary": "/nonexistent"},
+	} {
+		if _, err := newZstdFilter(conf); err == nil {
+			t.Fatalf("Expected %v to fail", conf)
+		}
+	}
+}